@@ -1,21 +1,40 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/anotherjesse/r8im/pkg/cli"
 )
 
+// exitInterrupted is returned when r8im is stopped by SIGINT or SIGTERM,
+// following the shell convention of 128 + SIGINT.
+const exitInterrupted = 130
+
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// restore default handling so a second Ctrl-C kills us outright
+		<-ctx.Done()
+		stop()
+	}()
+
 	cmd, err := cli.NewRootCommand()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	if err = cmd.Execute(); err != nil {
+	if err = cmd.ExecuteContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintln(os.Stderr, "interrupted:", err)
+			os.Exit(exitInterrupted)
+		}
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(cli.ExitCode(err))
 	}
 }
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultTokenTTL is how long a verification is trusted by default.
+const DefaultTokenTTL = time.Hour
+
+// TokenCache remembers successful token verifications on disk, keyed by
+// registry and a hash of the token so the token itself is never written. A
+// nil TokenCache is valid and caches nothing.
+type TokenCache struct {
+	dir string
+	ttl time.Duration
+}
+
+type cachedToken struct {
+	Registry string    `json:"registry"`
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+}
+
+// NewTokenCache returns a cache in dir whose entries expire after ttl.
+func NewTokenCache(dir string, ttl time.Duration) *TokenCache {
+	return &TokenCache{dir: dir, ttl: ttl}
+}
+
+// Get returns the username token was verified as on registry, if that
+// verification hasn't expired.
+func (c *TokenCache) Get(registry string, token string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	b, err := os.ReadFile(c.path(registry, token))
+	if err != nil {
+		return "", false
+	}
+	e := &cachedToken{}
+	if err := json.Unmarshal(b, e); err != nil || e.Registry != registry || time.Now().After(e.Expires) {
+		return "", false
+	}
+	return e.Username, true
+}
+
+// Put records that token belongs to username on registry.
+func (c *TokenCache) Put(registry string, token string, username string) error {
+	if c == nil {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&cachedToken{
+		Registry: registry,
+		Username: username,
+		Expires:  time.Now().Add(c.ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path(registry, token))
+}
+
+// Delete forgets any verification of token on registry.
+func (c *TokenCache) Delete(registry string, token string) error {
+	if c == nil {
+		return nil
+	}
+	err := os.Remove(c.path(registry, token))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *TokenCache) path(registry string, token string) string {
+	h := sha256.Sum256([]byte(registry + "\x00" + token))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:])+".json")
+}
@@ -1,13 +1,30 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 )
 
+var (
+	// ErrTokenRequired is returned when no cog token was given.
+	ErrTokenRequired = errors.New("token is required")
+	// ErrUserNotFound is returned when the registry knows no user for the
+	// token.
+	ErrUserNotFound = errors.New("user does not exist")
+	// ErrUnauthorized is returned when the registry rejects the credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// IsAuthError reports whether err is, or wraps, one of the errors above.
+func IsAuthError(err error) bool {
+	return errors.Is(err, ErrTokenRequired) || errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrUnauthorized)
+}
+
 func addressWithScheme(address string) string {
 	if strings.Contains(address, "://") {
 		return address
@@ -15,19 +32,61 @@ func addressWithScheme(address string) string {
 	return "https://" + address
 }
 
-func VerifyCogToken(registryHost string, token string) (username string, err error) {
+// Verifier checks cog tokens with a registry.
+type Verifier struct {
+	// Client sends the requests. Nil means http.DefaultClient.
+	Client *http.Client
+	// Insecure falls back to plain HTTP when the registry can't be reached
+	// over HTTPS.
+	Insecure bool
+	// Cache, if set, answers repeated verifications of the same token
+	// without asking the registry.
+	Cache *TokenCache
+}
+
+// VerifyCogToken asks registryHost which user token belongs to. A nil
+// client means http.DefaultClient.
+func VerifyCogToken(ctx context.Context, client *http.Client, registryHost string, token string) (username string, err error) {
+	v := &Verifier{Client: client}
+	return v.Verify(ctx, registryHost, token)
+}
+
+// Verify asks registryHost which user token belongs to.
+func (v *Verifier) Verify(ctx context.Context, registryHost string, token string) (username string, err error) {
 	if token == "" {
-		return "", fmt.Errorf("token is required")
+		return "", ErrTokenRequired
 	}
 
-	resp, err := http.PostForm(addressWithScheme(registryHost)+"/cog/v1/verify-token", url.Values{
-		"token": []string{token},
-	})
+	if username, ok := v.Cache.Get(registryHost, token); ok {
+		return username, nil
+	}
+
+	username, err = v.verify(ctx, registryHost, token)
+	if IsAuthError(err) {
+		v.Cache.Delete(registryHost, token)
+	}
+	if err != nil {
+		return "", err
+	}
+	// failing to cache only costs another request next time
+	v.Cache.Put(registryHost, token, username)
+	return username, nil
+}
+
+func (v *Verifier) verify(ctx context.Context, registryHost string, token string) (string, error) {
+	resp, err := v.post(ctx, addressWithScheme(registryHost), token)
+	if err != nil && v.Insecure && !strings.Contains(registryHost, "://") && ctx.Err() == nil {
+		resp, err = v.post(ctx, "http://"+registryHost, token)
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to verify token: %w", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusNotFound {
-		return "", fmt.Errorf("user does not exist")
+		return "", ErrUserNotFound
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("failed to verify token, got status %d: %w", resp.StatusCode, ErrUnauthorized)
 	}
 	if resp.StatusCode != http.StatusOK {
 		return "", fmt.Errorf("failed to verify token, got status %d", resp.StatusCode)
@@ -40,3 +99,20 @@ func VerifyCogToken(registryHost string, token string) (username string, err err
 	}
 	return body.Username, nil
 }
+
+func (v *Verifier) post(ctx context.Context, address string, token string) (*http.Response, error) {
+	form := url.Values{
+		"token": []string{token},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address+"/cog/v1/verify-token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
@@ -0,0 +1,442 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	gcrcache "github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+// DefaultMaxSize is the size limit used when none is given: 50GiB.
+const DefaultMaxSize int64 = 50 << 30
+
+// Cache is an on-disk blob cache keyed by layer digest. Blobs are stored
+// compressed, exactly as the registry served them, so a cached layer can be
+// used in place of the remote one for both Compressed() and Uncompressed().
+//
+// Cache implements go-containerregistry's cache.Cache so it can be layered
+// under any v1.Image with Image().
+type Cache struct {
+	dir     string
+	maxSize int64
+}
+
+var _ gcrcache.Cache = &Cache{}
+
+// Entry describes a single cached blob.
+type Entry struct {
+	Digest    v1.Hash         `json:"digest"`
+	DiffID    v1.Hash         `json:"diffID"`
+	MediaType types.MediaType `json:"mediaType"`
+	Size      int64           `json:"size"`
+	LastUsed  time.Time       `json:"-"`
+}
+
+// DefaultDir returns the cache directory used when none is given:
+// $R8IM_CACHE_DIR, or r8im under the user's cache directory.
+func DefaultDir() (string, error) {
+	if dir := os.Getenv("R8IM_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("finding user cache dir: %w", err)
+	}
+	return filepath.Join(dir, "r8im"), nil
+}
+
+// New returns a Cache rooted at dir. Once the total size of cached blobs
+// exceeds maxSize, the least recently used blobs are evicted. A maxSize of
+// zero or less disables eviction.
+func New(dir string, maxSize int64) *Cache {
+	return &Cache{dir: dir, maxSize: maxSize}
+}
+
+// Dir returns the directory the cache is rooted at.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Image wraps img so that its layers are read from the cache when present
+// and written to it as they are read. A nil Cache returns img unchanged.
+func (c *Cache) Image(img v1.Image) v1.Image {
+	if c == nil {
+		return img
+	}
+	return gcrcache.Image(img, c)
+}
+
+// Put implements cache.Cache. The blob is written to the cache as the
+// returned layer is consumed, and only committed once it has been read in
+// full and its digest checks out.
+func (c *Cache) Put(l v1.Layer) (v1.Layer, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	diffID, err := l.DiffID()
+	if err != nil {
+		return nil, err
+	}
+	mt, err := l.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return nil, err
+	}
+	return &writingLayer{
+		Layer: l,
+		c:     c,
+		entry: Entry{Digest: digest, DiffID: diffID, MediaType: mt, Size: size},
+	}, nil
+}
+
+// Get implements cache.Cache. h may be either the digest or the diffID of
+// the cached layer.
+func (c *Cache) Get(h v1.Hash) (v1.Layer, error) {
+	entry, err := c.lookup(h)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := os.Chtimes(c.blobPath(entry.Digest), now, now); err != nil {
+		return nil, gcrcache.ErrNotFound
+	}
+	entry.LastUsed = now
+	return &cachedLayer{c: c, entry: *entry}, nil
+}
+
+// Delete implements cache.Cache. h may be either the digest or the diffID of
+// the cached layer.
+func (c *Cache) Delete(h v1.Hash) error {
+	entry, err := c.lookup(h)
+	if err != nil {
+		return err
+	}
+	return c.remove(*entry)
+}
+
+// List returns all cached blobs, most recently used first.
+func (c *Cache) List() ([]Entry, error) {
+	matches, err := filepath.Glob(filepath.Join(c.dir, "blobs", "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(matches))
+	for _, m := range matches {
+		entry, err := readEntry(m)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(c.blobPath(entry.Digest))
+		if err != nil {
+			// metadata without a blob is an interrupted write or delete
+			continue
+		}
+		entry.LastUsed = fi.ModTime()
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Prune evicts the least recently used blobs until the cache holds at most
+// maxSize bytes, returning the evicted entries. A maxSize of zero empties
+// the cache. Leftovers from interrupted downloads are removed as well, so
+// Prune must not run while another r8im process is filling the cache.
+func (c *Cache) Prune(maxSize int64) ([]Entry, error) {
+	evicted, err := c.evict(maxSize)
+	if err != nil {
+		return evicted, err
+	}
+	if err := os.RemoveAll(filepath.Join(c.dir, "tmp")); err != nil {
+		return evicted, err
+	}
+	return evicted, nil
+}
+
+func (c *Cache) evict(maxSize int64) ([]Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	evicted := make([]Entry, 0)
+	for i := len(entries) - 1; i >= 0 && total > maxSize; i-- {
+		if err := c.remove(entries[i]); err != nil {
+			return evicted, err
+		}
+		total -= entries[i].Size
+		evicted = append(evicted, entries[i])
+	}
+	return evicted, nil
+}
+
+// Verify rehashes every cached blob and returns the entries whose contents
+// no longer match their digest. Corrupted entries are removed when remove
+// is true.
+func (c *Cache) Verify(remove bool) ([]Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	corrupted := make([]Entry, 0)
+	for _, e := range entries {
+		f, err := os.Open(c.blobPath(e.Digest))
+		if err != nil {
+			return corrupted, err
+		}
+		h, size, err := v1.SHA256(f)
+		f.Close()
+		if err != nil {
+			return corrupted, err
+		}
+		if h == e.Digest && size == e.Size {
+			continue
+		}
+		corrupted = append(corrupted, e)
+		if remove {
+			if err := c.remove(e); err != nil {
+				return corrupted, err
+			}
+		}
+	}
+	return corrupted, nil
+}
+
+func (c *Cache) blobPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "blobs", h.Algorithm, h.Hex)
+}
+
+func (c *Cache) metaPath(h v1.Hash) string {
+	return c.blobPath(h) + ".json"
+}
+
+// diffIDPath points from an uncompressed diffID back to the digest of the
+// blob holding it, so Uncompressed() lookups hit the same blob.
+func (c *Cache) diffIDPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "diffids", h.Algorithm, h.Hex)
+}
+
+func (c *Cache) lookup(h v1.Hash) (*Entry, error) {
+	entry, err := readEntry(c.metaPath(h))
+	if err == nil {
+		return entry, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	b, err := os.ReadFile(c.diffIDPath(h))
+	if os.IsNotExist(err) {
+		return nil, gcrcache.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	digest, err := v1.NewHash(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, gcrcache.ErrNotFound
+	}
+	entry, err = readEntry(c.metaPath(digest))
+	if os.IsNotExist(err) {
+		return nil, gcrcache.ErrNotFound
+	}
+	return entry, err
+}
+
+func readEntry(path string) (*Entry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{}
+	if err := json.Unmarshal(b, entry); err != nil {
+		return nil, fmt.Errorf("reading cache entry %s: %w", path, err)
+	}
+	return entry, nil
+}
+
+func (c *Cache) remove(e Entry) error {
+	for _, p := range []string{c.metaPath(e.Digest), c.blobPath(e.Digest), c.diffIDPath(e.DiffID)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// commit moves a fully written temporary blob into place and evicts old
+// blobs if the cache has grown past its limit.
+func (c *Cache) commit(tmp string, e Entry) error {
+	if c.maxSize > 0 && e.Size > c.maxSize {
+		return os.Remove(tmp)
+	}
+	for _, dir := range []string{filepath.Dir(c.blobPath(e.Digest)), filepath.Dir(c.diffIDPath(e.DiffID))} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.blobPath(e.Digest)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.metaPath(e.Digest), b, 0o600); err != nil {
+		return err
+	}
+	if e.DiffID != e.Digest {
+		if err := os.WriteFile(c.diffIDPath(e.DiffID), []byte(e.Digest.String()), 0o600); err != nil {
+			return err
+		}
+	}
+	if c.maxSize > 0 {
+		if _, err := c.evict(c.maxSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writingLayer tees the compressed blob into the cache as it is read.
+type writingLayer struct {
+	v1.Layer
+	c     *Cache
+	entry Entry
+}
+
+func (l *writingLayer) Compressed() (io.ReadCloser, error) {
+	tmpDir := filepath.Join(l.c.dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(tmpDir, l.entry.Digest.Hex+"-*")
+	if err != nil {
+		return nil, err
+	}
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	h := sha256.New()
+	return &teeReadCloser{
+		rc:    rc,
+		f:     f,
+		h:     h,
+		w:     io.MultiWriter(f, h),
+		c:     l.c,
+		entry: l.entry,
+	}, nil
+}
+
+func (l *writingLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return r8Layers.Decompress(rc)
+}
+
+type teeReadCloser struct {
+	rc    io.ReadCloser
+	f     *os.File
+	h     hash.Hash
+	w     io.Writer
+	n     int64
+	eof   bool
+	c     *Cache
+	entry Entry
+}
+
+func (t *teeReadCloser) Read(b []byte) (int, error) {
+	n, err := t.rc.Read(b)
+	if n > 0 {
+		if _, werr := t.w.Write(b[:n]); werr != nil {
+			return n, werr
+		}
+		t.n += int64(n)
+	}
+	if err == io.EOF {
+		t.eof = true
+	}
+	return n, err
+}
+
+// Close commits the blob only if it was read to the end and matches its
+// digest; partial reads are discarded rather than cached.
+func (t *teeReadCloser) Close() error {
+	err := t.rc.Close()
+	if ferr := t.f.Close(); err == nil {
+		err = ferr
+	}
+	complete := t.eof && t.n == t.entry.Size &&
+		hex.EncodeToString(t.h.Sum(nil)) == t.entry.Digest.Hex
+	if err != nil || !complete {
+		os.Remove(t.f.Name())
+		return err
+	}
+	if cerr := t.c.commit(t.f.Name(), t.entry); cerr != nil {
+		os.Remove(t.f.Name())
+		return fmt.Errorf("caching %s: %w", t.entry.Digest, cerr)
+	}
+	return nil
+}
+
+// cachedLayer is a layer served from a committed blob.
+type cachedLayer struct {
+	c     *Cache
+	entry Entry
+}
+
+var _ v1.Layer = &cachedLayer{}
+
+func (l *cachedLayer) Digest() (v1.Hash, error) {
+	return l.entry.Digest, nil
+}
+
+func (l *cachedLayer) DiffID() (v1.Hash, error) {
+	return l.entry.DiffID, nil
+}
+
+func (l *cachedLayer) Size() (int64, error) {
+	return l.entry.Size, nil
+}
+
+func (l *cachedLayer) MediaType() (types.MediaType, error) {
+	return l.entry.MediaType, nil
+}
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(l.c.blobPath(l.entry.Digest))
+}
+
+func (l *cachedLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return r8Layers.Decompress(rc)
+}
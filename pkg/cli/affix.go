@@ -2,62 +2,103 @@ package cli
 
 import (
 	"fmt"
-	"os"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/spf13/cobra"
 
-	"github.com/anotherjesse/r8im/pkg/auth"
 	"github.com/anotherjesse/r8im/pkg/images"
 )
 
-var (
-	sToken    string
-	sRegistry string
+type affixOptions struct {
+	*rootOptions
+
 	baseRef   string
 	dest      string
 	tar       string
-)
+	dir       string
+	layers    int
+	layerSize string
+	delta     deltaOptions
+}
+
+func newAffixCommand(root *rootOptions) *cobra.Command {
+	o := &affixOptions{rootOptions: root}
 
-func newAffixCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:    "affix",
-		Short:  "add a new layer to an existing image",
+		Short:  "add a new weights layer, or several, to an existing image",
 		Hidden: false,
-		RunE:   affixCommmand,
+		RunE:   o.run,
 	}
 
-	cmd.Flags().StringVarP(&sToken, "token", "t", "", "replicate cog token")
-	cmd.Flags().StringVarP(&sRegistry, "registry", "r", "r8.im", "registry host")
-	cmd.Flags().StringVarP(&baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
+	cmd.Flags().StringVarP(&o.baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
 	cmd.MarkFlagRequired("base")
-	cmd.Flags().StringVarP(&dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
+	cmd.Flags().StringVarP(&o.dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
 	cmd.MarkFlagRequired("dest")
-	cmd.Flags().StringVarP(&tar, "tar", "f", "", "tar file to append as new layer")
-	cmd.MarkFlagRequired("tar")
+	cmd.Flags().StringVarP(&o.tar, "tar", "f", "", "tar file to append as new layer")
 	cmd.MarkFlagFilename("tar", "tar", "tar.gz", "tgz")
+	cmd.Flags().StringVar(&o.dir, "dir", "", "weights directory to append under /src/weights")
+	cmd.MarkFlagDirname("dir")
+	cmd.MarkFlagsMutuallyExclusive("tar", "dir")
+	cmd.Flags().IntVar(&o.layers, "layers", 0, "split --dir into layers of its total size over this, rounded to a power of two, so about this many layers")
+	cmd.Flags().StringVar(&o.layerSize, "layer-size", "", "split --dir into layers of about this size on average, e.g. 2GB, and between a quarter and 4 times it; larger files get a layer each")
+	cmd.MarkFlagsMutuallyExclusive("layers", "layer-size")
+	addDeltaFlags(cmd, &o.delta, "--base")
+	cmd.MarkFlagsMutuallyExclusive("delta", "layers")
+	cmd.MarkFlagsMutuallyExclusive("delta", "layer-size")
+	addProgressFlags(cmd, root)
 
 	return cmd
 }
 
-func affixCommmand(cmd *cobra.Command, args []string) error {
-	if sToken == "" {
-		sToken = os.Getenv("COG_TOKEN")
+func (o *affixOptions) run(cmd *cobra.Command, args []string) error {
+	if o.tar == "" && o.dir == "" {
+		return fmt.Errorf("set --tar or --dir")
+	}
+	var split images.WeightsSplit
+	if o.layerSize != "" {
+		size, err := parseSize(o.layerSize)
+		if err != nil {
+			return fmt.Errorf("invalid --layer-size %q: %w", o.layerSize, err)
+		}
+		split.LayerSize = size
+	}
+	split.Layers = o.layers
+	if o.dir == "" && (split.Layers != 0 || split.LayerSize != 0) {
+		return fmt.Errorf("--layers and --layer-size need --dir")
+	}
+	if o.dir == "" && o.delta.delta {
+		return fmt.Errorf("--delta needs --dir")
+	}
+	if !o.delta.delta && o.delta.manifest != "" {
+		return fmt.Errorf("--weights-manifest needs --delta")
+	}
+	manifest, err := o.delta.readManifest()
+	if err != nil {
+		return err
 	}
 
-	u, err := auth.VerifyCogToken(sRegistry, sToken)
+	opts, err := o.imageOptions(cmd, nil, o.baseRef, o.dest)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "authentication error, invalid token or registry host error")
 		return err
 	}
-	auth := authn.FromConfig(authn.AuthConfig{Username: u, Password: sToken})
 
-	image_id, err := images.Affix(baseRef, dest, tar, auth)
+	var result *images.AffixResult
+	if o.delta.delta {
+		result, err = images.AffixDelta(o.baseRef, o.dest, o.dir, manifest, opts...)
+	} else if o.dir != "" {
+		result, err = images.AffixDir(o.baseRef, o.dest, o.dir, split, opts...)
+	} else {
+		result, err = images.Affix(o.baseRef, o.dest, o.tar, opts...)
+	}
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(image_id)
+	o.logger.Info("appended weights", "layers", len(result.WeightsLayers))
+	o.logDelta(result.Delta)
+	o.logTransfer(result.Transfer)
+
+	fmt.Println(result.Ref)
 
 	return nil
 }
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+)
+
+type ancestorOptions struct {
+	*rootOptions
+	json bool
+}
+
+func newAncestorCommand(root *rootOptions) *cobra.Command {
+	o := &ancestorOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "ancestor <image> <image> [image...]",
+		Short: "find the base layers two or more images have in common",
+
+		RunE: o.run,
+		Args: cobra.MinimumNArgs(2),
+	}
+
+	cmd.Flags().BoolVar(&o.json, "json", false, "print the result as JSON")
+
+	return cmd
+}
+
+func (o *ancestorOptions) run(cmd *cobra.Command, args []string) error {
+	opts, err := o.imageOptions(cmd, nil, args...)
+	if err != nil {
+		return err
+	}
+
+	a, err := images.CommonAncestor(args, opts...)
+	if err != nil {
+		return err
+	}
+
+	if o.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(a); err != nil {
+			return err
+		}
+	} else if err := writeAncestry(a); err != nil {
+		return err
+	}
+
+	if !a.SamePlatform {
+		o.logger.Warn("images are for different platforms")
+	}
+	if len(a.Shared) == 0 {
+		return fmt.Errorf("%w: the images share no layers", images.ErrBaseMismatch)
+	}
+	return nil
+}
+
+func writeAncestry(a *images.Ancestry) error {
+	var size int64
+	for _, l := range a.Shared {
+		size += l.Size
+	}
+	fmt.Printf("shared: %d layers, %s\n", len(a.Shared), formatSize(size))
+	if n := len(a.Shared); n > 0 {
+		l := a.Shared[n-1]
+		fmt.Printf("last shared layer: %s %s\n", l.Digest, truncate(l.CreatedBy, 60))
+	}
+	fmt.Println()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tPLATFORM\tLAYERS\tDIVERGES AT\tCREATED BY")
+	for _, img := range a.Images {
+		at, createdBy := "-", ""
+		if img.Diverges != nil {
+			at = fmt.Sprintf("%d %s", img.Diverges.Index, layerDigest(img.Diverges))
+			createdBy = truncate(img.Diverges.CreatedBy, 60)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", img.Ref, img.Platform, img.Layers, at, createdBy)
+	}
+	return tw.Flush()
+}
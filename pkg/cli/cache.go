@@ -0,0 +1,217 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/cache"
+)
+
+// cacheOptions are the flags that select the blob cache.
+type cacheOptions struct {
+	dir     string
+	maxSize string
+	disable bool
+}
+
+type cacheCommandOptions struct {
+	*rootOptions
+	cache cacheOptions
+
+	pruneAll     bool
+	verifyRemove bool
+}
+
+func newCacheCommand(root *rootOptions) *cobra.Command {
+	o := &cacheCommandOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "inspect and manage the local blob cache",
+	}
+
+	cmd.PersistentFlags().StringVar(&o.cache.dir, "cache-dir", "", "blob cache directory (default $R8IM_CACHE_DIR or the user cache dir)")
+	cmd.PersistentFlags().StringVar(&o.cache.maxSize, "cache-max-size", "50GB", "evict least recently used blobs beyond this size")
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "list cached blobs, most recently used first",
+		RunE:  o.list,
+		Args:  cobra.NoArgs,
+	}
+
+	prune := &cobra.Command{
+		Use:   "prune",
+		Short: "evict least recently used blobs down to --cache-max-size",
+		RunE:  o.prune,
+		Args:  cobra.NoArgs,
+	}
+	prune.Flags().BoolVar(&o.pruneAll, "all", false, "remove every cached blob")
+
+	verify := &cobra.Command{
+		Use:   "verify",
+		Short: "rehash cached blobs and report corrupted ones",
+		RunE:  o.verify,
+		Args:  cobra.NoArgs,
+	}
+	verify.Flags().BoolVar(&o.verifyRemove, "remove", false, "remove corrupted blobs")
+
+	cmd.AddCommand(list, prune, verify)
+
+	return cmd
+}
+
+// addCacheFlags registers the flags for commands that read layer contents
+// and can be served from the blob cache.
+func addCacheFlags(cmd *cobra.Command, o *cacheOptions) {
+	cmd.Flags().StringVar(&o.dir, "cache-dir", "", "blob cache directory (default $R8IM_CACHE_DIR or the user cache dir)")
+	cmd.Flags().StringVar(&o.maxSize, "cache-max-size", "50GB", "evict least recently used blobs beyond this size")
+	cmd.Flags().BoolVar(&o.disable, "no-cache", false, "always download layers from the registry")
+}
+
+// open returns the cache configured by flags, or nil if it is disabled.
+func (o *cacheOptions) open() (*cache.Cache, error) {
+	if o.disable || os.Getenv("R8IM_NO_CACHE") != "" {
+		return nil, nil
+	}
+	return o.openDir()
+}
+
+// openDir returns the cache configured by flags even if it is disabled, for
+// the cache subcommands to manage what is left in it.
+func (o *cacheOptions) openDir() (*cache.Cache, error) {
+	dir := o.dir
+	if dir == "" {
+		var err error
+		dir, err = cache.DefaultDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxSize, err := parseSize(o.maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --cache-max-size: %w", err)
+	}
+
+	return cache.New(dir, maxSize), nil
+}
+
+func (o *cacheCommandOptions) list(cmd *cobra.Command, args []string) error {
+	c, err := o.cache.openDir()
+	if err != nil {
+		return err
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tSIZE\tMEDIA TYPE\tLAST USED")
+	for _, e := range entries {
+		total += e.Size
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Digest, formatSize(e.Size), e.MediaType, e.LastUsed.Format(time.RFC3339))
+	}
+	w.Flush()
+
+	o.logger.Info("cache contents", "blobs", len(entries), "size", formatSize(total), "dir", c.Dir())
+
+	return nil
+}
+
+func (o *cacheCommandOptions) prune(cmd *cobra.Command, args []string) error {
+	c, err := o.cache.openDir()
+	if err != nil {
+		return err
+	}
+
+	maxSize, err := parseSize(o.cache.maxSize)
+	if err != nil {
+		return fmt.Errorf("invalid --cache-max-size: %w", err)
+	}
+	if o.pruneAll {
+		maxSize = 0
+	}
+
+	evicted, err := c.Prune(maxSize)
+	var freed int64
+	for _, e := range evicted {
+		freed += e.Size
+		fmt.Println(e.Digest)
+	}
+	o.logger.Info("pruned cache", "evicted", len(evicted), "freed", formatSize(freed))
+
+	return err
+}
+
+func (o *cacheCommandOptions) verify(cmd *cobra.Command, args []string) error {
+	c, err := o.cache.openDir()
+	if err != nil {
+		return err
+	}
+
+	corrupted, err := c.Verify(o.verifyRemove)
+	for _, e := range corrupted {
+		fmt.Println(e.Digest)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(corrupted) > 0 {
+		if o.verifyRemove {
+			o.logger.Info("removed corrupted blobs", "count", len(corrupted))
+			return nil
+		}
+		return fmt.Errorf("%d corrupted blobs in cache", len(corrupted))
+	}
+
+	o.logger.Info("cache ok")
+
+	return nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses sizes like "50GB", "512MB" or "1024". Units are binary.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.Replace(s, "IB", "B", 1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), 64)
+			if err != nil {
+				return 0, err
+			}
+			return int64(n * float64(u.mult)), nil
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func formatSize(n int64) string {
+	for _, u := range sizeUnits {
+		if n >= u.mult && u.mult > 1 {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(u.mult), u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
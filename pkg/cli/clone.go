@@ -2,51 +2,75 @@ package cli
 
 import (
 	"fmt"
-	"os"
+	"strings"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/spf13/cobra"
 
-	"github.com/anotherjesse/r8im/pkg/auth"
 	"github.com/anotherjesse/r8im/pkg/images"
 )
 
-func newCloneCommand() *cobra.Command {
+type cloneOptions struct {
+	*rootOptions
+
+	baseRef      string
+	dest         string
+	labels       []string
+	removeLabels []string
+}
+
+func newCloneCommand(root *rootOptions) *cobra.Command {
+	o := &cloneOptions{rootOptions: root}
+
 	cmd := &cobra.Command{
 		Use:    "clone",
 		Short:  "copy existing image to a new image",
 		Hidden: false,
-		RunE:   cloneCommmand,
+		RunE:   o.run,
 	}
 
-	cmd.Flags().StringVarP(&sToken, "token", "t", "", "replicate cog token")
-	cmd.Flags().StringVarP(&sRegistry, "registry", "r", "r8.im", "registry host")
-	cmd.Flags().StringVarP(&baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
+	cmd.Flags().StringVarP(&o.baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
 	cmd.MarkFlagRequired("base")
-	cmd.Flags().StringVarP(&dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
+	cmd.Flags().StringVarP(&o.dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
 	cmd.MarkFlagRequired("dest")
+	cmd.Flags().StringArrayVar(&o.labels, "label", nil, "set a label, as key=value (repeatable); changes the digest")
+	cmd.Flags().StringArrayVar(&o.removeLabels, "remove-label", nil, "remove a label (repeatable); changes the digest")
+	addProgressFlags(cmd, root)
 
 	return cmd
 }
 
-func cloneCommmand(cmd *cobra.Command, args []string) error {
-	if sToken == "" {
-		sToken = os.Getenv("COG_TOKEN")
+func (o *cloneOptions) run(cmd *cobra.Command, args []string) error {
+	set, err := parseKeyValues(o.labels)
+	if err != nil {
+		return fmt.Errorf("invalid --label: %w", err)
 	}
 
-	u, err := auth.VerifyCogToken(sRegistry, sToken)
+	opts, err := o.imageOptions(cmd, nil, o.baseRef, o.dest)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "authentication error, invalid token or registry host error")
 		return err
 	}
-	auth := authn.FromConfig(authn.AuthConfig{Username: u, Password: sToken})
 
-	image_id, err := images.Affix(baseRef, dest, "", auth)
+	result, err := images.Clone(o.baseRef, o.dest, images.LabelEdit{Set: set, Remove: o.removeLabels}, opts...)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(image_id)
+	o.logTransfer(result.Transfer)
+
+	fmt.Println(result.Ref)
 
 	return nil
 }
+
+// parseKeyValues parses a list of key=value pairs.
+func parseKeyValues(pairs []string) (map[string]string, error) {
+	m := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", p)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
@@ -0,0 +1,258 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+)
+
+func newCogCommand(root *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cog",
+		Short: "show, validate, diff and replace the cog labels of an image",
+	}
+
+	cmd.AddCommand(
+		newCogShowCommand(root),
+		newCogValidateCommand(root),
+		newCogDiffCommand(root),
+		newCogSetCommand(root),
+	)
+
+	return cmd
+}
+
+// cogFields maps the values of --field to the keys of CogLabels.Decoded.
+var cogFields = map[string]string{
+	"config":         "config",
+	"openapi-schema": "openapi_schema",
+	"version":        "version",
+}
+
+type cogShowOptions struct {
+	*rootOptions
+	field string
+}
+
+func newCogShowCommand(root *rootOptions) *cobra.Command {
+	o := &cogShowOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "show <image>",
+		Short: "pretty-print the cog labels of an image",
+		RunE:  o.run,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	cmd.Flags().StringVar(&o.field, "field", "", "only print one label: config, openapi-schema or version")
+
+	return cmd
+}
+
+func (o *cogShowOptions) run(cmd *cobra.Command, args []string) error {
+	key, ok := cogFields[o.field]
+	if o.field != "" && !ok {
+		return fmt.Errorf("unknown --field %q, expected config, openapi-schema or version", o.field)
+	}
+
+	opts, err := o.imageOptions(cmd, nil, args[0])
+	if err != nil {
+		return err
+	}
+	labels, err := images.ReadCogLabels(args[0], opts...)
+	if err != nil {
+		return err
+	}
+
+	var v interface{} = labels.Decoded()
+	if key != "" {
+		if v = labels.Decoded()[key]; v == nil {
+			return fmt.Errorf("%w: image has no %s label", images.ErrInvalidCogLabels, o.field)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+type cogValidateOptions struct {
+	*rootOptions
+}
+
+func newCogValidateCommand(root *rootOptions) *cobra.Command {
+	o := &cogValidateOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "validate <image>",
+		Short: "check that the cog labels of an image are present and parse",
+		RunE:  o.run,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	return cmd
+}
+
+func (o *cogValidateOptions) run(cmd *cobra.Command, args []string) error {
+	opts, err := o.imageOptions(cmd, nil, args[0])
+	if err != nil {
+		return err
+	}
+	labels, err := images.ReadCogLabels(args[0], opts...)
+	if err != nil {
+		return err
+	}
+
+	problems := labels.Problems()
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %d problems in %s", images.ErrInvalidCogLabels, len(problems), args[0])
+	}
+	o.logger.Info("cog labels are valid", "image", args[0], "version", labels.Version)
+	return nil
+}
+
+type cogDiffOptions struct {
+	*rootOptions
+	json bool
+}
+
+func newCogDiffCommand(root *rootOptions) *cobra.Command {
+	o := &cogDiffOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "diff <image-a> <image-b>",
+		Short: "compare the cog labels of two images field by field",
+		RunE:  o.run,
+		Args:  cobra.ExactArgs(2),
+	}
+
+	cmd.Flags().BoolVar(&o.json, "json", false, "print the changes as a JSON array")
+
+	return cmd
+}
+
+func (o *cogDiffOptions) run(cmd *cobra.Command, args []string) error {
+	opts, err := o.imageOptions(cmd, nil, args...)
+	if err != nil {
+		return err
+	}
+
+	var labels [2]*images.CogLabels
+	for i, ref := range args {
+		if labels[i], err = images.ReadCogLabels(ref, opts...); err != nil {
+			return err
+		}
+	}
+
+	changes := images.DiffCogLabels(labels[0], labels[1])
+	if o.json {
+		if changes == nil {
+			changes = []images.FieldChange{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	writeFieldChanges(tw, changes)
+	return tw.Flush()
+}
+
+type cogSetOptions struct {
+	*rootOptions
+
+	baseRef       string
+	dest          string
+	config        string
+	openAPISchema string
+	version       string
+}
+
+func newCogSetCommand(root *rootOptions) *cobra.Command {
+	o := &cogSetOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "set",
+		Short: "replace the cog labels of an image from local files",
+		RunE:  o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
+	cmd.MarkFlagRequired("base")
+	cmd.Flags().StringVarP(&o.dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
+	cmd.MarkFlagRequired("dest")
+	cmd.Flags().StringVar(&o.config, "config", "", "cog.yaml, or its JSON form as printed by cog show --field config")
+	cmd.MarkFlagFilename("config", "yaml", "yml", "json")
+	cmd.Flags().StringVar(&o.openAPISchema, "openapi-schema", "", "OpenAPI schema JSON file")
+	cmd.MarkFlagFilename("openapi-schema", "json")
+	cmd.Flags().StringVar(&o.version, "version", "", "cog version")
+	addProgressFlags(cmd, root)
+
+	return cmd
+}
+
+func (o *cogSetOptions) run(cmd *cobra.Command, args []string) error {
+	labels, err := o.labels()
+	if err != nil {
+		return err
+	}
+	edit, err := labels.Edit()
+	if err != nil {
+		return err
+	}
+	if edit.Empty() {
+		return fmt.Errorf("nothing to change, set --config, --openapi-schema or --version")
+	}
+
+	opts, err := o.imageOptions(cmd, nil, o.baseRef, o.dest)
+	if err != nil {
+		return err
+	}
+
+	result, err := images.EditConfig(o.baseRef, o.dest, images.ConfigEdit{Labels: edit}, opts...)
+	if err != nil {
+		return err
+	}
+
+	o.logTransfer(result.Transfer)
+
+	fmt.Println(result.Ref)
+
+	return nil
+}
+
+// labels reads the cog labels given by the flags.
+func (o *cogSetOptions) labels() (*images.CogLabels, error) {
+	labels := &images.CogLabels{Version: o.version}
+
+	if o.config != "" {
+		b, err := os.ReadFile(o.config)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(filepath.Ext(o.config), ".json") {
+			labels.Config = b
+		} else if labels.Config, err = images.CogConfigFromYAML(b); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", images.ErrInvalidCogLabels, o.config, err)
+		}
+	}
+
+	if o.openAPISchema != "" {
+		b, err := os.ReadFile(o.openAPISchema)
+		if err != nil {
+			return nil, err
+		}
+		labels.OpenAPISchema = b
+	}
+	return labels, nil
+}
@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+)
+
+type configOptions struct {
+	*rootOptions
+
+	baseRef      string
+	dest         string
+	env          []string
+	unsetEnv     []string
+	labels       []string
+	removeLabels []string
+	entrypoint   string
+	cmd          string
+	workdir      string
+	user         string
+	expose       []string
+	unexpose     []string
+	stopSignal   string
+}
+
+func newConfigCommand(root *rootOptions) *cobra.Command {
+	o := &configOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "edit the config of an existing image without touching its layers",
+		RunE:  o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
+	cmd.MarkFlagRequired("base")
+	cmd.Flags().StringVarP(&o.dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
+	cmd.MarkFlagRequired("dest")
+	cmd.Flags().StringArrayVar(&o.env, "env", nil, "set an environment variable, as key=value (repeatable)")
+	cmd.Flags().StringArrayVar(&o.unsetEnv, "unset-env", nil, "remove an environment variable (repeatable)")
+	cmd.Flags().StringArrayVar(&o.labels, "label", nil, "set a label, as key=value (repeatable)")
+	cmd.Flags().StringArrayVar(&o.removeLabels, "remove-label", nil, "remove a label (repeatable)")
+	cmd.Flags().StringVar(&o.entrypoint, "entrypoint", "", `entrypoint, as a JSON array or space-separated words; "" clears it`)
+	cmd.Flags().StringVar(&o.cmd, "cmd", "", `command, as a JSON array or space-separated words; "" clears it`)
+	cmd.Flags().StringVar(&o.workdir, "workdir", "", "working directory")
+	cmd.Flags().StringVar(&o.user, "user", "", "user, as user[:group]")
+	cmd.Flags().StringArrayVar(&o.expose, "expose", nil, "expose a port, as port[/protocol] (repeatable)")
+	cmd.Flags().StringArrayVar(&o.unexpose, "unexpose", nil, "stop exposing a port, as port[/protocol] (repeatable)")
+	cmd.Flags().StringVar(&o.stopSignal, "stop-signal", "", "signal sent to stop the container, e.g. SIGINT")
+	addProgressFlags(cmd, root)
+
+	return cmd
+}
+
+func (o *configOptions) run(cmd *cobra.Command, args []string) error {
+	edit, err := o.edit(cmd)
+	if err != nil {
+		return err
+	}
+	if edit.Empty() {
+		return fmt.Errorf("nothing to change, see --help for the config flags")
+	}
+
+	opts, err := o.imageOptions(cmd, nil, o.baseRef, o.dest)
+	if err != nil {
+		return err
+	}
+
+	result, err := images.EditConfig(o.baseRef, o.dest, edit, opts...)
+	if err != nil {
+		return err
+	}
+
+	o.logTransfer(result.Transfer)
+
+	fmt.Println(result.Ref)
+
+	return nil
+}
+
+// edit returns the config changes asked for by the flags that were set.
+func (o *configOptions) edit(cmd *cobra.Command) (images.ConfigEdit, error) {
+	var edit images.ConfigEdit
+	var err error
+
+	if edit.SetEnv, err = parseKeyValues(o.env); err != nil {
+		return edit, fmt.Errorf("invalid --env: %w", err)
+	}
+	edit.UnsetEnv = o.unsetEnv
+	if edit.Labels.Set, err = parseKeyValues(o.labels); err != nil {
+		return edit, fmt.Errorf("invalid --label: %w", err)
+	}
+	edit.Labels.Remove = o.removeLabels
+	edit.Expose = o.expose
+	edit.Unexpose = o.unexpose
+
+	flags := cmd.Flags()
+	if flags.Changed("entrypoint") {
+		if edit.Entrypoint, err = parseCommand(o.entrypoint); err != nil {
+			return edit, fmt.Errorf("invalid --entrypoint: %w", err)
+		}
+	}
+	if flags.Changed("cmd") {
+		if edit.Cmd, err = parseCommand(o.cmd); err != nil {
+			return edit, fmt.Errorf("invalid --cmd: %w", err)
+		}
+	}
+	if flags.Changed("workdir") {
+		edit.WorkingDir = &o.workdir
+	}
+	if flags.Changed("user") {
+		edit.User = &o.user
+	}
+	if flags.Changed("stop-signal") {
+		edit.StopSignal = &o.stopSignal
+	}
+	return edit, nil
+}
+
+// parseCommand parses an entrypoint or cmd given either as a JSON array,
+// like a Dockerfile's exec form, or as space-separated words. It never
+// returns nil, so that "" clears the setting.
+func parseCommand(s string) ([]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(s), "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(s), &args); err != nil {
+			return nil, err
+		}
+		if args == nil {
+			args = []string{}
+		}
+		return args, nil
+	}
+	return append([]string{}, strings.Fields(s)...), nil
+}
@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+// deltaOptions are the flags for appending only the weights that changed.
+type deltaOptions struct {
+	delta    bool
+	manifest string
+}
+
+func addDeltaFlags(cmd *cobra.Command, o *deltaOptions, against string) {
+	cmd.Flags().BoolVar(&o.delta, "delta", false, "append only the files of --dir that differ from the weights of "+against+", with whiteouts for removed ones")
+	cmd.Flags().StringVar(&o.manifest, "weights-manifest", "", "manifest of the weights of "+against+", as written by extract, instead of reading it from the image")
+	cmd.MarkFlagFilename("weights-manifest", "json")
+}
+
+// readManifest returns the manifest given by --weights-manifest, or nil.
+func (o *deltaOptions) readManifest() (*r8Layers.Manifest, error) {
+	if o.manifest == "" {
+		return nil, nil
+	}
+	return r8Layers.ReadManifest(o.manifest)
+}
+
+func (r *rootOptions) logDelta(d *images.WeightsDelta) {
+	if d == nil {
+		return
+	}
+	for _, p := range d.Changed {
+		r.logger.Debug("changed", "path", p)
+	}
+	for _, p := range d.Removed {
+		r.logger.Debug("removed", "path", p)
+	}
+	r.logger.Info("appended delta", "layer", d.Layer, "changed", len(d.Changed), "removed", len(d.Removed))
+}
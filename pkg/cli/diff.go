@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+)
+
+type diffOptions struct {
+	*rootOptions
+	cache cacheOptions
+
+	files bool
+	json  bool
+}
+
+func newDiffCommand(root *rootOptions) *cobra.Command {
+	o := &diffOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "diff <image-a> <image-b>",
+		Short: "compare the config, layers, history and optionally files of two images",
+
+		RunE: o.run,
+		Args: cobra.ExactArgs(2),
+	}
+
+	cmd.Flags().BoolVar(&o.files, "files", false, "also compare the merged filesystems, which downloads every layer")
+	cmd.Flags().BoolVar(&o.json, "json", false, "print the differences as JSON")
+	addCacheFlags(cmd, &o.cache)
+	addProgressFlags(cmd, root)
+
+	return cmd
+}
+
+func (o *diffOptions) run(cmd *cobra.Command, args []string) error {
+	c, err := o.cache.open()
+	if err != nil {
+		return err
+	}
+
+	opts, err := o.imageOptions(cmd, c, args...)
+	if err != nil {
+		return err
+	}
+
+	d, err := images.Diff(args[0], args[1], o.files, opts...)
+	if err != nil {
+		return err
+	}
+
+	if o.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+	if d.Empty() {
+		o.logger.Info("no differences", "a", d.A, "b", d.B)
+		return nil
+	}
+	return writeImageDiff(os.Stdout, d)
+}
+
+// writeImageDiff prints the non-empty sections of d as tables.
+func writeImageDiff(w io.Writer, d *images.ImageDiff) error {
+	section := func(title string, print func(tw *tabwriter.Writer)) error {
+		fmt.Fprintf(w, "%s:\n", title)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		print(tw)
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+		return nil
+	}
+
+	if len(d.Config) > 0 {
+		if err := section("config", func(tw *tabwriter.Writer) {
+			writeFieldChanges(tw, d.Config)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if len(d.Layers) > 0 {
+		if err := section("layers", func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "CHANGE\tA\tB\tDIGEST A\tDIGEST B\tSIZE\tCREATED BY")
+			for _, c := range d.Layers {
+				l := c.B
+				if l == nil {
+					l = c.A
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					c.Change, layerIndex(c.A), layerIndex(c.B), layerDigest(c.A), layerDigest(c.B),
+					formatSize(l.Size), truncate(l.CreatedBy, 60))
+			}
+		}); err != nil {
+			return err
+		}
+	}
+
+	if len(d.History) > 0 {
+		if err := section("history", func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "CHANGE\tINDEX\tCREATED BY\tCOMMENT")
+			for _, c := range d.History {
+				createdBy := c.History.CreatedBy
+				if c.History.EmptyLayer {
+					createdBy += " (empty)"
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", c.Change, c.Index, truncate(createdBy, 60), c.History.Comment)
+			}
+		}); err != nil {
+			return err
+		}
+	}
+
+	if len(d.Files) > 0 {
+		if err := section("files", func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "CHANGE\tPATH\tSIZE A\tSIZE B")
+			for _, c := range d.Files {
+				a, b := formatSize(c.SizeA), formatSize(c.SizeB)
+				switch c.Change {
+				case images.ChangeAdded:
+					a = "-"
+				case images.ChangeRemoved:
+					b = "-"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Change, c.Path, a, b)
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func layerIndex(l *images.DiffLayer) string {
+	if l == nil {
+		return "-"
+	}
+	return strconv.Itoa(l.Index)
+}
+
+func layerDigest(l *images.DiffLayer) string {
+	if l == nil {
+		return "-"
+	}
+	if len(l.Digest.Hex) > 12 {
+		return l.Digest.Hex[:12]
+	}
+	return l.Digest.Hex
+}
+
+// writeFieldChanges prints changes as rows of tw, with "-" for a missing
+// side. Write errors come out when the caller flushes tw.
+func writeFieldChanges(tw *tabwriter.Writer, changes []images.FieldChange) {
+	fmt.Fprintln(tw, "FIELD\tA\tB")
+	for _, c := range changes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Path, formatValue(c.A), formatValue(c.B))
+	}
+}
+
+// formatValue returns v as compact JSON on one line, shortened if long.
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return truncate(strings.ReplaceAll(string(b), "\t", " "), 80)
+}
+
+// truncate shortens s to n bytes, marking it with "..." if it was cut.
+func truncate(s string, n int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if len(s) <= n {
+		return s
+	}
+	if n <= 3 {
+		return s[:n]
+	}
+	return s[:n-3] + "..."
+}
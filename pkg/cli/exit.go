@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"errors"
+
+	"github.com/anotherjesse/r8im/pkg/auth"
+	"github.com/anotherjesse/r8im/pkg/images"
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+// Exit codes returned by r8im. They are part of the command line interface;
+// don't renumber them.
+const (
+	ExitOK               = 0
+	ExitError            = 1
+	ExitAuth             = 3
+	ExitNotFound         = 4
+	ExitNoWeights        = 5
+	ExitHistoryMismatch  = 6
+	ExitPushDenied       = 7
+	ExitVerifyFailed     = 8
+	ExitInvalidCog       = 9
+	ExitBaseMismatch     = 10
+	ExitUnchanged        = 11
+	ExitManifestMismatch = 12
+)
+
+// ExitCode returns the exit status r8im uses for err.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, images.ErrPushDenied):
+		return ExitPushDenied
+	case auth.IsAuthError(err):
+		return ExitAuth
+	case errors.Is(err, images.ErrNotFound):
+		return ExitNotFound
+	case errors.Is(err, images.ErrNoWeights):
+		return ExitNoWeights
+	case errors.Is(err, images.ErrHistoryMismatch):
+		return ExitHistoryMismatch
+	case errors.Is(err, r8Layers.ErrVerifyFailed):
+		return ExitVerifyFailed
+	case errors.Is(err, images.ErrInvalidCogLabels):
+		return ExitInvalidCog
+	case errors.Is(err, images.ErrBaseMismatch):
+		return ExitBaseMismatch
+	case errors.Is(err, images.ErrWeightsUnchanged):
+		return ExitUnchanged
+	case errors.Is(err, images.ErrManifestMismatch):
+		return ExitManifestMismatch
+	}
+	return ExitError
+}
@@ -2,94 +2,74 @@ package cli
 
 import (
 	"fmt"
-	"os"
-	"strings"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/spf13/cobra"
 
-	"github.com/anotherjesse/r8im/pkg/auth"
 	"github.com/anotherjesse/r8im/pkg/images"
 	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
 )
 
-func newExtractCommand() *cobra.Command {
+type extractOptions struct {
+	*rootOptions
+	cache cacheOptions
+
+	output       string
+	manifestPath string
+}
+
+func newExtractCommand(root *rootOptions) *cobra.Command {
+	o := &extractOptions{rootOptions: root}
+
 	cmd := &cobra.Command{
 		Use:    "extract <image> [--output file]",
 		Short:  "extract weights from image",
 		Hidden: false,
 
-		RunE: extractCommand,
+		RunE: o.run,
 		Args: cobra.ExactArgs(1),
 	}
 
-	cmd.Flags().StringVarP(&sToken, "token", "t", "", "replicate cog token")
-	cmd.Flags().StringVarP(&dest, "output", "o", "", "destination tar file")
+	cmd.Flags().StringVarP(&o.output, "output", "o", "", "destination tar file")
+	cmd.Flags().StringVarP(&o.manifestPath, "manifest", "m", "", "write a weights manifest to this file (default <output>.manifest.json when --output is set)")
+	addCacheFlags(cmd, &o.cache)
+	addProgressFlags(cmd, root)
 
 	return cmd
 }
 
-func extractCommand(cmd *cobra.Command, args []string) error {
-	if sToken == "" {
-		sToken = os.Getenv("COG_TOKEN")
-	}
-
-	if len(args) == 0 {
-		return nil
-	}
-
-	u, err := auth.VerifyCogToken(sRegistry, sToken)
+func (o *extractOptions) run(cmd *cobra.Command, args []string) error {
+	c, err := o.cache.open()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "authentication error, invalid token or registry host error")
 		return err
 	}
-	auth := authn.FromConfig(authn.AuthConfig{Username: u, Password: sToken})
 
 	imageName := args[0]
-	layers, err := images.Layers(imageName, auth)
+	opts, err := o.imageOptions(cmd, c, imageName)
 	if err != nil {
 		return err
 	}
 
-	weightsFound := false
-
-	for _, layer := range layers {
-		if strings.HasSuffix(layer.Command, " # weights") {
-			l := layer.Raw
-			rc, err := l.Uncompressed()
-			if err != nil {
-				return err
-			}
-			weightsFound, err = r8Layers.ExtractTarWithoutPrefixAndIgnoreWhiteout(rc, dest)
-			if err != nil {
-				return err
-			}
-			if weightsFound {
-				return nil
-			}
-		}
+	result, err := images.ExtractWeights(imageName, o.output, opts...)
+	if err != nil {
+		return err
 	}
 
-	for _, layer := range layers {
-		if strings.HasPrefix(layer.Command, "COPY . /src") {
-			l := layer.Raw
-			rc, err := l.Uncompressed()
-			if err != nil {
-				return err
-			}
-			weightsFound, err = r8Layers.ExtractTarWithoutPrefixAndIgnoreWhiteout(rc, dest)
-			if err != nil {
-				return err
-			}
-			if weightsFound {
-				return nil
-			}
-		}
+	return o.writeManifest(result.Manifest)
+}
+
+func (o *extractOptions) writeManifest(m *r8Layers.Manifest) error {
+	path := o.manifestPath
+	if path == "" && o.output != "" {
+		path = o.output + ".manifest.json"
+	}
+	if path == "" {
+		return nil
 	}
 
-	if !weightsFound {
-		return fmt.Errorf("no weights found")
+	if err := r8Layers.WriteManifest(path, m); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
 	}
+	o.logger.Info("wrote manifest", "files", len(m.Files), "path", path)
 
 	return nil
 }
@@ -2,49 +2,47 @@ package cli
 
 import (
 	"fmt"
-	"os"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/spf13/cobra"
 
-	"github.com/anotherjesse/r8im/pkg/auth"
 	"github.com/anotherjesse/r8im/pkg/images"
 )
 
-func newLayerCommand() *cobra.Command {
+type layersOptions struct {
+	*rootOptions
+}
+
+func newLayerCommand(root *rootOptions) *cobra.Command {
+	o := &layersOptions{rootOptions: root}
+
 	cmd := &cobra.Command{
 		Use:    "layers [image]",
-		Short:  "list layers of an existing image",
+		Short:  "list layers of an existing image, or delete, move, reorder or squash them",
 		Hidden: false,
 
-		RunE: layersCommmand,
+		RunE: o.run,
 		Args: cobra.ExactArgs(1),
 	}
 
-	cmd.Flags().StringVarP(&sToken, "token", "t", "", "replicate cog token")
+	cmd.AddCommand(
+		newLayersDeleteCommand(root),
+		newLayersMoveCommand(root),
+		newLayersReorderCommand(root),
+		newLayersSquashCommand(root),
+	)
 
 	return cmd
 }
 
-func layersCommmand(cmd *cobra.Command, args []string) error {
-	if sToken == "" {
-		sToken = os.Getenv("COG_TOKEN")
-	}
-
-	if len(args) == 0 {
-		return nil
-	}
+func (o *layersOptions) run(cmd *cobra.Command, args []string) error {
+	imageName := args[0]
 
-	u, err := auth.VerifyCogToken(sRegistry, sToken)
+	opts, err := o.imageOptions(cmd, nil, imageName)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "authentication error, invalid token or registry host error")
 		return err
 	}
-	auth := authn.FromConfig(authn.AuthConfig{Username: u, Password: sToken})
-
-	imageName := args[0]
 
-	layers, err := images.Layers(imageName, auth)
+	layers, err := images.Layers(imageName, opts...)
 	if err != nil {
 		return err
 	}
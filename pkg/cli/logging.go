@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/logs"
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/logging"
+	"github.com/anotherjesse/r8im/pkg/progress"
+)
+
+func addLoggingFlags(cmd *cobra.Command, root *rootOptions) {
+	cmd.PersistentFlags().BoolVarP(&root.verbose, "verbose", "v", false, "log debug messages, including go-containerregistry's")
+	cmd.PersistentFlags().BoolVarP(&root.quiet, "quiet", "q", false, "only log warnings and errors, and hide progress unless --progress is set")
+	cmd.PersistentFlags().StringVar(&root.logFormat, "log-format", logging.FormatText, "log format: text or json (one JSON object per line)")
+}
+
+// setupLogging creates the logger and progress reporter for the command
+// being run, and routes go-containerregistry's logs through the logger.
+func (r *rootOptions) setupLogging(cmd *cobra.Command, args []string) error {
+	level := logging.LevelInfo
+	if r.verbose {
+		level = logging.LevelDebug
+	}
+	if r.quiet {
+		level = logging.LevelWarn
+	}
+
+	// commands without --progress don't transfer layers, and --quiet hides
+	// progress unless it was asked for explicitly
+	format := progress.FormatNone
+	if f := cmd.Flags().Lookup("progress"); f != nil && (f.Changed || !r.quiet) {
+		format = r.progress
+	}
+
+	var err error
+	r.reporter, err = progress.New(os.Stderr, format)
+	if err != nil {
+		return err
+	}
+
+	r.logger, err = logging.New(r.reporter.Writer(os.Stderr), level, r.logFormat)
+	if err != nil {
+		return err
+	}
+
+	gcr := r.logger.With("component", "gcr")
+	logs.Warn = gcr.StdLogger(logging.LevelWarn)
+	logs.Progress = gcr.StdLogger(logging.LevelInfo)
+	logs.Debug = gcr.StdLogger(logging.LevelDebug)
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/auth"
+	"github.com/anotherjesse/r8im/pkg/cache"
+	"github.com/anotherjesse/r8im/pkg/images"
+)
+
+// Values for --auth.
+const (
+	authAuto      = "auto"
+	authCog       = "cog"
+	authKeychain  = "keychain"
+	authAnonymous = "anonymous"
+)
+
+func addAuthFlags(cmd *cobra.Command, root *rootOptions) {
+	cmd.PersistentFlags().StringVarP(&root.token, "token", "t", "", "replicate cog token (default $COG_TOKEN)")
+	cmd.PersistentFlags().StringVarP(&root.registry, "registry", "r", "r8.im", "cog registry host that verifies the token")
+	cmd.PersistentFlags().StringVar(&root.auth, "auth", authAuto, "how to authenticate: auto (cog token for cog registries, docker config elsewhere), cog (verify --token and use it everywhere), keychain (docker config) or anonymous")
+	cmd.PersistentFlags().BoolVar(&root.skipVerify, "skip-verify", false, "don't verify the token with the registry, leaving it to reject bad credentials (needs --username unless a verification is cached)")
+	cmd.PersistentFlags().StringVar(&root.username, "username", "", "registry username for --skip-verify (default $COG_USERNAME)")
+	cmd.PersistentFlags().DurationVar(&root.tokenTTL, "token-cache-ttl", auth.DefaultTokenTTL, "how long to remember a successful token verification; 0 disables the cache")
+}
+
+// authOptions returns the pkg/images options that authenticate to the
+// registries of refs, as selected by --auth.
+//
+// With auto, the cog token is only verified and used for refs on a cog
+// registry: --registry, or a host with "cog": true in --registry-config.
+// Other registries, such as Docker Hub or a local registry, get whatever
+// the docker config has for them, which is anonymous if nothing.
+func (r *rootOptions) authOptions(ctx context.Context, refs ...string) ([]images.Option, error) {
+	switch r.auth {
+	case authAuto:
+	case authCog:
+		a, err := r.cogAuthenticator(ctx, r.registry, r.cogToken())
+		if err != nil {
+			return nil, err
+		}
+		return []images.Option{images.WithAuth(a)}, nil
+	case authKeychain:
+		return nil, nil
+	case authAnonymous:
+		return []images.Option{images.WithAuth(authn.Anonymous)}, nil
+	default:
+		return nil, fmt.Errorf("unknown --auth %q, expected auto, cog, keychain or anonymous", r.auth)
+	}
+
+	token := r.cogToken()
+	var opts []images.Option
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		host := images.RegistryOf(ref)
+		if seen[host] || !r.isCogRegistry(host) {
+			continue
+		}
+		seen[host] = true
+
+		if token == "" {
+			r.logger.Warn("no cog token, using docker credentials", "registry", host)
+			continue
+		}
+		a, err := r.cogAuthenticator(ctx, host, token)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, images.WithAuthFor(host, a))
+	}
+	return opts, nil
+}
+
+func (r *rootOptions) cogToken() string {
+	if r.token != "" {
+		return r.token
+	}
+	return os.Getenv("COG_TOKEN")
+}
+
+// isCogRegistry reports whether host verifies tokens at /cog/v1/verify-token.
+func (r *rootOptions) isCogRegistry(host string) bool {
+	return host != "" && (host == r.registry || r.transportOpts.Host(host).Cog)
+}
+
+// cogAuthenticator verifies token with the cog registry host, unless
+// --skip-verify is set, and returns credentials for it.
+func (r *rootOptions) cogAuthenticator(ctx context.Context, host string, token string) (authn.Authenticator, error) {
+	if token == "" {
+		return nil, auth.ErrTokenRequired
+	}
+
+	tokens, err := r.tokenCache()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.skipVerify {
+		u := r.username
+		if u == "" {
+			u = os.Getenv("COG_USERNAME")
+		}
+		if u == "" {
+			var ok bool
+			if u, ok = tokens.Get(host, token); !ok {
+				return nil, fmt.Errorf("--skip-verify needs --username when no verification is cached: %w", auth.ErrTokenRequired)
+			}
+		}
+		return authn.FromConfig(authn.AuthConfig{Username: u, Password: token}), nil
+	}
+
+	v := &auth.Verifier{
+		Client:   r.httpClient(),
+		Insecure: r.transportOpts.Host(host).Insecure,
+		Cache:    tokens,
+	}
+	u, err := v.Verify(ctx, host, token)
+	if err != nil {
+		r.logger.Error("authentication error, invalid token or registry host error", "registry", host)
+		return nil, err
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: u, Password: token}), nil
+}
+
+// tokenCache returns the cache of token verifications, or nil if
+// --token-cache-ttl is 0.
+func (r *rootOptions) tokenCache() (*auth.TokenCache, error) {
+	if r.tokenTTL <= 0 {
+		return nil, nil
+	}
+	dir, err := cache.DefaultDir()
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewTokenCache(filepath.Join(dir, "tokens"), r.tokenTTL), nil
+}
+
+// imageOptions returns the options shared by every command that talks to
+// the registries of refs through pkg/images.
+func (r *rootOptions) imageOptions(cmd *cobra.Command, c *cache.Cache, refs ...string) ([]images.Option, error) {
+	authOpts, err := r.authOptions(cmd.Context(), refs...)
+	if err != nil {
+		return nil, err
+	}
+	opts := []images.Option{
+		images.WithContext(cmd.Context()),
+		images.WithCache(c),
+		images.WithProgress(r.reporter),
+		images.WithLogger(r.logger),
+	}
+	opts = append(opts, authOpts...)
+	return append(opts, r.registryOptions()...), nil
+}
+
+// logTransfer logs which blobs of a pushed image were mounted from another
+// repository, uploaded or already present, and how much wasn't uploaded.
+func (r *rootOptions) logTransfer(t images.Transfer) {
+	for _, h := range t.Mounted {
+		r.logger.Info("mounted", "blob", h)
+	}
+	for _, h := range t.Uploaded {
+		r.logger.Info("uploaded", "blob", h)
+	}
+	for _, h := range t.Existing {
+		r.logger.Debug("already present", "blob", h)
+	}
+	r.logger.Info("pushed", "mounted", len(t.Mounted), "uploaded", len(t.Uploaded), "existing", len(t.Existing), "saved", formatSize(t.BytesSaved))
+}
@@ -0,0 +1,12 @@
+package cli
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/progress"
+)
+
+// addProgressFlags registers the flags for commands that transfer layers.
+func addProgressFlags(cmd *cobra.Command, root *rootOptions) {
+	cmd.Flags().StringVar(&root.progress, "progress", progress.FormatAuto, "progress output: auto, bar, plain, json (one JSON object per line) or none")
+}
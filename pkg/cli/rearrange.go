@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+)
+
+type rearrangeOptions struct {
+	*rootOptions
+
+	baseRef string
+	dest    string
+	to      int
+}
+
+func (o *rearrangeOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&o.baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
+	cmd.MarkFlagRequired("base")
+	cmd.Flags().StringVarP(&o.dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
+	cmd.MarkFlagRequired("dest")
+	addProgressFlags(cmd, o.rootOptions)
+}
+
+// layerArgsHelp tells how to pass negative indexes, which would otherwise
+// be taken for flags.
+const layerArgsHelp = "Layers are named by index or digest prefix. Negative indexes count back\nfrom the last layer; put them after --, e.g. -- -1."
+
+func newLayersDeleteCommand(root *rootOptions) *cobra.Command {
+	o := &rearrangeOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "delete --base <image> --dest <image-dest> [--] <layer>...",
+		Short: "remove layers from an image",
+		Long:  layerArgsHelp,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd, func(opts []images.Option) (*images.RearrangeResult, error) {
+				return images.DeleteLayers(o.baseRef, o.dest, args, opts...)
+			})
+		},
+	}
+	o.addFlags(cmd)
+
+	return cmd
+}
+
+func newLayersMoveCommand(root *rootOptions) *cobra.Command {
+	o := &rearrangeOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "move --base <image> --dest <image-dest> --to <index> [--] <layer>",
+		Short: "move a layer of an image to another position",
+		Long:  layerArgsHelp,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd, func(opts []images.Option) (*images.RearrangeResult, error) {
+				return images.MoveLayer(o.baseRef, o.dest, args[0], o.to, opts...)
+			})
+		},
+	}
+	o.addFlags(cmd)
+	cmd.Flags().IntVar(&o.to, "to", 0, "index to move the layer to; negative counts back from the last layer")
+	cmd.MarkFlagRequired("to")
+
+	return cmd
+}
+
+func newLayersReorderCommand(root *rootOptions) *cobra.Command {
+	o := &rearrangeOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "reorder --base <image> --dest <image-dest> [--] <layer>...",
+		Short: "put the layers of an image in the given order, naming each once",
+		Long:  layerArgsHelp,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd, func(opts []images.Option) (*images.RearrangeResult, error) {
+				return images.ReorderLayers(o.baseRef, o.dest, args, opts...)
+			})
+		},
+	}
+	o.addFlags(cmd)
+
+	return cmd
+}
+
+func (o *rearrangeOptions) run(cmd *cobra.Command, rearrange func([]images.Option) (*images.RearrangeResult, error)) error {
+	opts, err := o.imageOptions(cmd, nil, o.baseRef, o.dest)
+	if err != nil {
+		return err
+	}
+
+	result, err := rearrange(opts)
+	if err != nil {
+		return err
+	}
+
+	o.logger.Info("rearranged layers", "order", result.Order)
+	o.logTransfer(result.Transfer)
+
+	fmt.Println(result.Ref)
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+)
+
+type rebaseOptions struct {
+	*rootOptions
+
+	imageRef string
+	oldBase  string
+	newBase  string
+	dest     string
+	force    bool
+}
+
+func newRebaseCommand(root *rootOptions) *cobra.Command {
+	o := &rebaseOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "rebase --image <image> --old-base <image> --new-base <image> --dest <image-dest>",
+		Short: "move the layers of an image from its old base onto a new one",
+
+		RunE: o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.imageRef, "image", "i", "", "image to rebase - include tag: r8.im/username/modelname@sha256:hexdigest")
+	cmd.MarkFlagRequired("image")
+	cmd.Flags().StringVar(&o.oldBase, "old-base", "", "base image the image was built on")
+	cmd.MarkFlagRequired("old-base")
+	cmd.Flags().StringVar(&o.newBase, "new-base", "", "base image to move the image onto")
+	cmd.MarkFlagRequired("new-base")
+	cmd.Flags().StringVarP(&o.dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
+	cmd.MarkFlagRequired("dest")
+	cmd.Flags().BoolVar(&o.force, "force", false, "rebase even if the image only shares some of the old base's layers")
+	addProgressFlags(cmd, root)
+
+	return cmd
+}
+
+func (o *rebaseOptions) run(cmd *cobra.Command, args []string) error {
+	opts, err := o.imageOptions(cmd, nil, o.imageRef, o.oldBase, o.newBase, o.dest)
+	if err != nil {
+		return err
+	}
+
+	result, err := images.Rebase(o.imageRef, o.oldBase, o.newBase, o.dest, o.force, opts...)
+	if err != nil {
+		return err
+	}
+
+	o.logger.Info("rebased", "replaced", result.Replaced, "kept", result.Kept)
+	o.logTransfer(result.Transfer)
+
+	fmt.Println(result.Ref)
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+)
+
+type rechunkOptions struct {
+	*rootOptions
+	cache cacheOptions
+
+	baseRef     string
+	dest        string
+	maxLayers   int
+	minSize     string
+	keepMtimes  bool
+	compression string
+}
+
+func newRechunkCommand(root *rootOptions) *cobra.Command {
+	o := &rechunkOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "rechunk --base <image> --dest <image-dest>",
+		Short: "regroup the files of an image into per-package layers that similar images share",
+
+		RunE: o.run,
+		Args: cobra.NoArgs,
+	}
+
+	cmd.Flags().StringVarP(&o.baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
+	cmd.MarkFlagRequired("base")
+	cmd.Flags().StringVarP(&o.dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
+	cmd.MarkFlagRequired("dest")
+	cmd.Flags().IntVar(&o.maxLayers, "max-layers", 100, "most layers to make")
+	cmd.Flags().StringVar(&o.minSize, "min-size", "1MB", "merge groups of files smaller than this into their parent directory's")
+	cmd.Flags().BoolVar(&o.keepMtimes, "keep-mtimes", false, "keep file modification times instead of clearing them")
+	cmd.Flags().StringVar(&o.compression, "compression", string(images.CompressionGzip), "compression of the layers: gzip, zstd or none")
+	addCacheFlags(cmd, &o.cache)
+	addProgressFlags(cmd, root)
+
+	return cmd
+}
+
+func (o *rechunkOptions) run(cmd *cobra.Command, args []string) error {
+	minSize, err := parseSize(o.minSize)
+	if err != nil {
+		return fmt.Errorf("invalid --min-size %q: %w", o.minSize, err)
+	}
+	if o.maxLayers < 1 {
+		return fmt.Errorf("--max-layers must be at least 1")
+	}
+
+	c, err := o.cache.open()
+	if err != nil {
+		return err
+	}
+
+	opts, err := o.imageOptions(cmd, c, o.baseRef, o.dest)
+	if err != nil {
+		return err
+	}
+
+	result, err := images.Rechunk(o.baseRef, o.dest, images.Chunking{
+		MaxLayers:   o.maxLayers,
+		MinSize:     minSize,
+		KeepMtimes:  o.keepMtimes,
+		Compression: images.Compression(o.compression),
+	}, opts...)
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range result.Chunks {
+		o.logger.Info("chunk", "key", chunk.Key, "files", chunk.Files, "size", formatSize(chunk.Size), "digest", chunk.Digest)
+	}
+	o.logTransfer(result.Transfer)
+
+	fmt.Println(result.Ref)
+
+	return nil
+}
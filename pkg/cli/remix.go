@@ -2,61 +2,79 @@ package cli
 
 import (
 	"fmt"
-	"os"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/spf13/cobra"
 
-	"github.com/anotherjesse/r8im/pkg/auth"
 	"github.com/anotherjesse/r8im/pkg/images"
 )
 
-var (
+type remixOptions struct {
+	*rootOptions
+
+	baseRef    string
 	weightsRef string
-)
+	dest       string
+	dir        string
+	delta      deltaOptions
+}
+
+func newRemixCommand(root *rootOptions) *cobra.Command {
+	o := &remixOptions{rootOptions: root}
 
-func newRemixCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:    "remix --base <image-including-tag> --weights <image-including-tag> --dest <image-dest>",
 		Short:  "remix layers of an existing image",
 		Hidden: false,
 
-		RunE: remixCommmand,
+		RunE: o.run,
 	}
 
-	cmd.Flags().StringVarP(&sToken, "token", "t", "", "replicate cog token")
-	cmd.Flags().StringVarP(&sRegistry, "registry", "r", "r8.im", "registry host")
-
-	cmd.Flags().StringVarP(&baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
+	cmd.Flags().StringVarP(&o.baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
 	cmd.MarkFlagRequired("base")
-	cmd.Flags().StringVarP(&weightsRef, "weights", "w", "", "weights image reference - include tag: r8.im/username/weights@sha256:hexdigest")
+	cmd.Flags().StringVarP(&o.weightsRef, "weights", "w", "", "weights image reference - include tag: r8.im/username/weights@sha256:hexdigest")
 	cmd.MarkFlagRequired("weights")
-	cmd.Flags().StringVarP(&dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
+	cmd.Flags().StringVarP(&o.dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
 	cmd.MarkFlagRequired("dest")
+	cmd.Flags().StringVar(&o.dir, "dir", "", "local weights directory to compare with --delta")
+	cmd.MarkFlagDirname("dir")
+	addDeltaFlags(cmd, &o.delta, "--weights")
+	addProgressFlags(cmd, root)
 
 	return cmd
 }
 
-func remixCommmand(cmd *cobra.Command, args []string) error {
-	if sToken == "" {
-		sToken = os.Getenv("COG_TOKEN")
+func (o *remixOptions) run(cmd *cobra.Command, args []string) error {
+	if o.delta.delta != (o.dir != "") {
+		return fmt.Errorf("--delta and --dir go together")
 	}
-
-	u, err := auth.VerifyCogToken(sRegistry, sToken)
+	if !o.delta.delta && o.delta.manifest != "" {
+		return fmt.Errorf("--weights-manifest needs --delta")
+	}
+	manifest, err := o.delta.readManifest()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "authentication error, invalid token or registry host error")
 		return err
 	}
-	auth := authn.FromConfig(authn.AuthConfig{Username: u, Password: sToken})
 
-	fmt.Fprintln(os.Stderr, "remix time")
-	url, err := images.ReallyRemix(baseRef, weightsRef, dest, auth)
-
-	fmt.Println(url)
+	opts, err := o.imageOptions(cmd, nil, o.baseRef, o.weightsRef, o.dest)
+	if err != nil {
+		return err
+	}
 
+	o.logger.Info("remix time")
+	var result *images.RemixResult
+	if o.delta.delta {
+		result, err = images.RemixDelta(o.baseRef, o.weightsRef, o.dest, o.dir, manifest, opts...)
+	} else {
+		result, err = images.Remix(o.baseRef, o.weightsRef, o.dest, opts...)
+	}
 	if err != nil {
 		return err
 	}
 
+	o.logDelta(result.Delta)
+	o.logTransfer(result.Transfer)
+
+	fmt.Println(result.Ref)
+
 	return nil
 }
@@ -1,31 +1,76 @@
 package cli
 
 import (
-	"log"
-	"os"
+	"net/http"
+	"time"
 
-	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/logging"
+	"github.com/anotherjesse/r8im/pkg/progress"
+	r8Transport "github.com/anotherjesse/r8im/pkg/transport"
 )
 
+// rootOptions holds the flags shared by every command and the logger and
+// progress reporter set up from them. NewRootCommand makes a fresh one each
+// time, so nothing carries over between invocations in the same process.
+type rootOptions struct {
+	token      string
+	registry   string
+	auth       string
+	username   string
+	skipVerify bool
+	tokenTTL   time.Duration
+
+	timeout        time.Duration
+	retries        int
+	insecure       bool
+	caFile         string
+	registryConfig string
+
+	verbose   bool
+	quiet     bool
+	logFormat string
+	progress  string
+
+	logger        *logging.Logger
+	reporter      *progress.Reporter
+	transportOpts r8Transport.Options
+	transport     http.RoundTripper
+}
+
 func NewRootCommand() (*cobra.Command, error) {
+	root := &rootOptions{}
+
 	rootCmd := cobra.Command{
-		Use:           "r8im",
-		Short:         "replicate.com helpers",
-		Version:       "0.0.1",
-		SilenceErrors: true,
+		Use:               "r8im",
+		Short:             "replicate.com helpers",
+		Version:           "0.0.1",
+		SilenceErrors:     true,
+		PersistentPreRunE: root.setup,
 	}
 
+	addAuthFlags(&rootCmd, root)
+	addLoggingFlags(&rootCmd, root)
+	addTransportFlags(&rootCmd, root)
+
 	rootCmd.AddCommand(
-		newAffixCommand(),
-		newCloneCommand(),
-		newLayerCommand(),
-		newExtractCommand(),
-		newRemixCommand(),
-		newZstdCommand(),
+		newAffixCommand(root),
+		newAncestorCommand(root),
+		newCacheCommand(root),
+		newCloneCommand(root),
+		newCogCommand(root),
+		newConfigCommand(root),
+		newDiffCommand(root),
+		newLayerCommand(root),
+		newExtractCommand(root),
+		newRebaseCommand(root),
+		newRechunkCommand(root),
+		newRemixCommand(root),
+		newVerifyCommand(root),
+		newWeightsCommand(root),
+		newZstdCommand(root),
 	)
-	logs.Warn = log.New(os.Stderr, "gcr WARN: ", log.LstdFlags)
-	logs.Progress = log.New(os.Stderr, "gcr: ", log.LstdFlags)
 
 	return &rootCmd, nil
 }
@@ -0,0 +1,330 @@
+package cli
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+const (
+	testUser  = "alice"
+	testToken = "r8_test"
+)
+
+// testRegistry is an in-process registry that, like r8.im, verifies cog
+// tokens at /cog/v1/verify-token and only lets in testUser with testToken.
+type testRegistry struct {
+	host string
+
+	mu       sync.Mutex
+	verified []string
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+	r := &testRegistry{}
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/cog/v1/verify-token" {
+			token := req.FormValue("token")
+			r.mu.Lock()
+			r.verified = append(r.verified, token)
+			r.mu.Unlock()
+			if token != testToken {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"username": testUser})
+			return
+		}
+		if u, p, ok := req.BasicAuth(); !ok || u != testUser || p != testToken {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, req)
+	}))
+	t.Cleanup(s.Close)
+	r.host = strings.TrimPrefix(s.URL, "http://")
+	return r
+}
+
+// lastVerified returns the last token the registry was asked to verify.
+func (r *testRegistry) lastVerified() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.verified) == 0 {
+		return ""
+	}
+	return r.verified[len(r.verified)-1]
+}
+
+// push writes a random image of one layer to repo and returns its ref.
+func (r *testRegistry) push(t *testing.T, repo string) string {
+	t.Helper()
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := r.host + "/" + repo
+	tag, err := name.NewTag(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authn.FromConfig(authn.AuthConfig{Username: testUser, Password: testToken})
+	if err := remote.Write(tag, img, remote.WithAuth(auth)); err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+// testEnv keeps the user's environment, caches and docker config out of
+// the commands run by the test.
+func testEnv(t *testing.T) {
+	t.Setenv("R8IM_CACHE_DIR", t.TempDir())
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	t.Setenv("COG_TOKEN", "")
+	t.Setenv("COG_USERNAME", "")
+	t.Setenv("R8IM_REGISTRY_CONFIG", "")
+}
+
+// execute runs r8im with args on a new root command, as main does, and
+// returns what the command printed to stdout.
+func execute(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	cmd, err := NewRootCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.SetArgs(args)
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+
+	f, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	err = cmd.ExecuteContext(context.Background())
+	os.Stdout = stdout
+
+	b, rerr := os.ReadFile(f.Name())
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return string(b), err
+}
+
+func writeFile(t *testing.T, path string, size int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeWeightsTar(t *testing.T, path string, files ...string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, name := range files {
+		hdr := &tar.Header{Name: "src/weights/" + name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(name))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCommandsInSequence runs commands one after another in the same
+// process, as a tool embedding r8im would, checking that the flags of one
+// run don't carry over to the next.
+func TestCommandsInSequence(t *testing.T) {
+	testEnv(t)
+	reg := newTestRegistry(t)
+	base := reg.push(t, "test/base:latest")
+	tmp := t.TempDir()
+	flags := []string{"-q", "--insecure", "--registry", reg.host, "--token", testToken}
+	run := func(args ...string) string {
+		t.Helper()
+		out, err := execute(t, append(args, flags...)...)
+		if err != nil {
+			t.Fatalf("%s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+
+	dir := filepath.Join(tmp, "weights")
+	writeFile(t, filepath.Join(dir, "a.bin"), 1024)
+	writeFile(t, filepath.Join(dir, "b.bin"), 1024)
+	weights := reg.host + "/test/weights:latest"
+	run("affix", "--base", base, "--dest", weights, "--dir", dir, "--layers", "2")
+
+	if got := strings.Split(strings.TrimSpace(run("layers", weights)), "\n"); len(got) != 3 {
+		t.Errorf("layers listed %q, want the base layer and 2 weights layers", got)
+	}
+
+	// --layers needs --dir, so this fails if it carried over
+	tarPath := filepath.Join(tmp, "weights.tar")
+	writeWeightsTar(t, tarPath, "c.bin")
+	run("affix", "--base", base, "--dest", reg.host+"/test/tar:latest", "--tar", tarPath)
+
+	output := filepath.Join(tmp, "out.tar")
+	run("extract", weights, "--output", output)
+	m, err := r8Layers.ReadManifest(output + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 2 {
+		t.Errorf("extract listed %d files, want 2", len(m.Files))
+	}
+
+	// without --output, the tar goes to stdout rather than the last output
+	if err := os.Remove(output); err != nil {
+		t.Fatal(err)
+	}
+	if out := run("extract", weights, "--manifest", filepath.Join(tmp, "only.json")); out == "" {
+		t.Error("extract without --output wrote nothing to stdout")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("extract without --output wrote %s", output)
+	}
+
+	zstd := reg.host + "/test/zstd:latest"
+	run("zstd", weights, zstd)
+	ref, err := name.ParseReference(zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authn.FromConfig(authn.AuthConfig{Username: testUser, Password: testToken})
+	img, err := remote.Image(ref, remote.WithAuth(auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layers {
+		if mt, err := l.MediaType(); err != nil || mt != types.OCILayerZStd {
+			t.Errorf("zstd layer has media type %q (%v)", mt, err)
+		}
+	}
+
+	// and nothing of the token or registry is left for a run without them
+	if _, err := execute(t, "-q", "--insecure", "layers", weights); ExitCode(err) != ExitAuth {
+		t.Errorf("layers without --token and --registry after runs with them: got %v, want an auth error", err)
+	}
+}
+
+// TestRegistryAndToken checks that --registry picks the registry the
+// token is verified with and used for, and that --token is the one used.
+func TestRegistryAndToken(t *testing.T) {
+	testEnv(t)
+	reg := newTestRegistry(t)
+	weights := reg.host + "/test/weights:latest"
+	tmp := t.TempDir()
+	writeWeightsTar(t, filepath.Join(tmp, "weights.tar"), "a.bin")
+	if _, err := execute(t, "-q", "--insecure", "--registry", reg.host, "--token", testToken,
+		"affix", "--base", reg.push(t, "test/base:latest"), "--dest", weights, "--tar", filepath.Join(tmp, "weights.tar")); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := map[string][]string{
+		"extract": {"extract", weights, "--output", filepath.Join(tmp, "out.tar")},
+		"layers":  {"layers", weights},
+		"zstd":    {"zstd", weights, reg.host + "/test/zstd:latest"},
+	}
+	for cmd, args := range commands {
+		t.Run(cmd, func(t *testing.T) {
+			run := func(flags ...string) error {
+				_, err := execute(t, append(append([]string{"-q", "--insecure"}, flags...), args...)...)
+				return err
+			}
+
+			// the token is only used for the cog registry, which is r8.im
+			// unless --registry says otherwise
+			if err := run("--token", testToken); ExitCode(err) != ExitAuth {
+				t.Errorf("without --registry: got %v, want an auth error", err)
+			}
+
+			if err := run("--registry", reg.host, "--token", "r8_wrong"); ExitCode(err) != ExitAuth {
+				t.Errorf("with a wrong --token: got %v, want an auth error", err)
+			}
+			if got := reg.lastVerified(); got != "r8_wrong" {
+				t.Errorf("registry verified %q, want the wrong --token", got)
+			}
+
+			if err := run("--registry", reg.host, "--token", testToken); err != nil {
+				t.Errorf("with --registry and --token: %v", err)
+			}
+		})
+	}
+}
+
+// TestNegativeLayerIndex checks that negative indexes after -- are taken
+// as layers rather than flags.
+func TestNegativeLayerIndex(t *testing.T) {
+	testEnv(t)
+	reg := newTestRegistry(t)
+	base := reg.push(t, "test/base:latest")
+	dir := filepath.Join(t.TempDir(), "weights")
+	writeFile(t, filepath.Join(dir, "a.bin"), 1024)
+	writeFile(t, filepath.Join(dir, "b.bin"), 1024)
+	flags := []string{"-q", "--insecure", "--registry", reg.host, "--token", testToken}
+	run := func(args ...string) string {
+		t.Helper()
+		out, err := execute(t, append(flags, args...)...)
+		if err != nil {
+			t.Fatalf("%s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+	countLayers := func(ref string) int {
+		t.Helper()
+		return len(strings.Split(strings.TrimSpace(run("layers", ref)), "\n"))
+	}
+
+	weights := reg.host + "/test/weights:latest"
+	run("affix", "--base", base, "--dest", weights, "--dir", dir, "--layers", "2")
+	n := countLayers(weights)
+
+	deleted := reg.host + "/test/deleted:latest"
+	run("layers", "delete", "--base", weights, "--dest", deleted, "--", "-1")
+	if got := countLayers(deleted); got != n-1 {
+		t.Errorf("delete -- -1 left %d layers, want %d", got, n-1)
+	}
+
+	run("layers", "move", "--base", weights, "--dest", reg.host+"/test/moved:latest", "--to", "0", "--", "-1")
+}
@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+)
+
+type squashOptions struct {
+	*rootOptions
+
+	baseRef     string
+	dest        string
+	from        string
+	to          string
+	compression string
+}
+
+func newLayersSquashCommand(root *rootOptions) *cobra.Command {
+	o := &squashOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "squash --base <image> --dest <image-dest> --from <layer> [--to <layer>]",
+		Short: "merge a range of layers of an image into one",
+		RunE:  o.run,
+		Args:  cobra.NoArgs,
+	}
+
+	cmd.Flags().StringVarP(&o.baseRef, "base", "b", "", "base image reference - include tag: r8.im/username/modelname@sha256:hexdigest")
+	cmd.MarkFlagRequired("base")
+	cmd.Flags().StringVarP(&o.dest, "dest", "d", "", "destination image reference: r8.im/username/modelname")
+	cmd.MarkFlagRequired("dest")
+	cmd.Flags().StringVar(&o.from, "from", "", "first layer to squash, by index or digest prefix")
+	cmd.MarkFlagRequired("from")
+	cmd.Flags().StringVar(&o.to, "to", "-1", "last layer to squash, by index or digest prefix")
+	cmd.Flags().StringVar(&o.compression, "compression", string(images.CompressionGzip), "compression of the squashed layer: gzip, zstd or none")
+	addProgressFlags(cmd, root)
+
+	return cmd
+}
+
+func (o *squashOptions) run(cmd *cobra.Command, args []string) error {
+	opts, err := o.imageOptions(cmd, nil, o.baseRef, o.dest)
+	if err != nil {
+		return err
+	}
+
+	result, err := images.SquashLayers(o.baseRef, o.dest, o.from, o.to, images.Compression(o.compression), opts...)
+	if err != nil {
+		return err
+	}
+
+	o.logger.Info("squashed layers", "layers", result.Squashed, "digest", result.Layer.Digest, "size", result.Layer.Size)
+	o.logTransfer(result.Transfer)
+
+	fmt.Println(result.Ref)
+
+	return nil
+}
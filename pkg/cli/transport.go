@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+	r8Transport "github.com/anotherjesse/r8im/pkg/transport"
+)
+
+func addTransportFlags(cmd *cobra.Command, root *rootOptions) {
+	cmd.PersistentFlags().DurationVar(&root.timeout, "timeout", r8Transport.DefaultTimeout, "how long to wait for a registry to accept a connection and respond (transfers themselves are not limited)")
+	cmd.PersistentFlags().IntVar(&root.retries, "retries", r8Transport.DefaultRetries, "how many times to retry token requests, blob uploads and manifest writes that time out, lose their connection, or fail with 429 or 5xx")
+	cmd.PersistentFlags().BoolVar(&root.insecure, "insecure", false, "allow plain HTTP and skip TLS certificate verification for every registry")
+	cmd.PersistentFlags().StringVar(&root.caFile, "ca-file", "", "PEM file of extra certificate authorities to trust")
+	cmd.PersistentFlags().StringVar(&root.registryConfig, "registry-config", "", "JSON file with per-host insecure and caFile settings (default $R8IM_REGISTRY_CONFIG)")
+}
+
+// transportOptions returns the retry, timeout and TLS settings from flags
+// and the registry config file.
+func (r *rootOptions) transportOptions() (r8Transport.Options, error) {
+	opts := r8Transport.DefaultOptions()
+	opts.Timeout = r.timeout
+	opts.Retries = r.retries
+	opts.Insecure = r.insecure
+	opts.CAFile = r.caFile
+	opts.Logger = r.logger
+
+	path := r.registryConfig
+	if path == "" {
+		path = os.Getenv("R8IM_REGISTRY_CONFIG")
+	}
+	if path != "" {
+		c, err := r8Transport.LoadConfig(path)
+		if err != nil {
+			return opts, err
+		}
+		opts.Hosts = c.Hosts
+	}
+
+	return opts, nil
+}
+
+// setup runs before every command: it sets up logging and the HTTP
+// transport shared by token verification and registry operations.
+func (r *rootOptions) setup(cmd *cobra.Command, args []string) error {
+	if err := r.setupLogging(cmd, args); err != nil {
+		return err
+	}
+
+	var err error
+	r.transportOpts, err = r.transportOptions()
+	if err != nil {
+		return err
+	}
+	r.transport, err = r8Transport.New(r.transportOpts)
+	return err
+}
+
+func (r *rootOptions) httpClient() *http.Client {
+	return &http.Client{Transport: r.transport}
+}
+
+// registryOptions returns the pkg/images options that send requests
+// through the shared transport, retried like token requests.
+func (r *rootOptions) registryOptions() []images.Option {
+	opts := []images.Option{
+		images.WithTransport(r.transport),
+		images.WithRetryBackoff(r.transportOpts.Backoff()),
+		images.WithRetryPredicate(r8Transport.Retryable),
+	}
+	if r.transportOpts.Insecure {
+		opts = append(opts, images.WithInsecure())
+	}
+	for _, host := range r.transportOpts.InsecureHosts() {
+		opts = append(opts, images.WithInsecureRegistry(host))
+	}
+	return opts
+}
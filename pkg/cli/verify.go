@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/anotherjesse/r8im/pkg/images"
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+type verifyOptions struct {
+	*rootOptions
+	cache cacheOptions
+
+	manifestPath string
+}
+
+func newVerifyCommand(root *rootOptions) *cobra.Command {
+	o := &verifyOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "verify <image> <dir> | verify --manifest <file> <dir>",
+		Short: "check a local weights directory against the weights in an image",
+
+		RunE: o.run,
+		Args: cobra.RangeArgs(1, 2),
+	}
+
+	cmd.Flags().StringVarP(&o.manifestPath, "manifest", "m", "", "verify against a manifest written by extract instead of reading the image")
+	addCacheFlags(cmd, &o.cache)
+	addProgressFlags(cmd, root)
+
+	return cmd
+}
+
+func (o *verifyOptions) run(cmd *cobra.Command, args []string) error {
+	var m *r8Layers.Manifest
+	var dir string
+	var err error
+
+	if o.manifestPath != "" {
+		if len(args) != 1 {
+			return fmt.Errorf("expected only a directory when --manifest is set")
+		}
+		dir = args[0]
+		m, err = r8Layers.ReadManifest(o.manifestPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		if len(args) != 2 {
+			return fmt.Errorf("expected an image and a directory")
+		}
+		dir = args[1]
+		m, err = o.imageManifest(cmd, &o.cache, args[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	report, err := r8Layers.VerifyDir(dir, m)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range report.Missing {
+		fmt.Println("missing", f.Path)
+	}
+	for _, path := range report.Extra {
+		fmt.Println("extra", path)
+	}
+	for _, c := range report.Corrupted {
+		fmt.Println("corrupted", c.Expected.Path)
+	}
+
+	if err := report.Err(); err != nil {
+		return err
+	}
+
+	o.logger.Info("files verified", "count", report.Matched)
+
+	return nil
+}
+
+// imageManifest returns the weights manifest of imageName.
+func (r *rootOptions) imageManifest(cmd *cobra.Command, co *cacheOptions, imageName string) (*r8Layers.Manifest, error) {
+	c, err := co.open()
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := r.imageOptions(cmd, c, imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	return images.WeightsManifest(imageName, opts...)
+}
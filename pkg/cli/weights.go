@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+type weightsOptions struct {
+	*rootOptions
+	cache cacheOptions
+}
+
+func newWeightsCommand(root *rootOptions) *cobra.Command {
+	o := &weightsOptions{rootOptions: root}
+
+	cmd := &cobra.Command{
+		Use:   "weights <image>",
+		Short: "print the weights manifest of an image",
+
+		RunE: o.run,
+		Args: cobra.ExactArgs(1),
+	}
+
+	addCacheFlags(cmd, &o.cache)
+	addProgressFlags(cmd, root)
+
+	return cmd
+}
+
+func (o *weightsOptions) run(cmd *cobra.Command, args []string) error {
+	m, err := o.imageManifest(cmd, &o.cache, args[0])
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
@@ -2,55 +2,57 @@ package cli
 
 import (
 	"fmt"
-	"os"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/spf13/cobra"
 
-	"github.com/anotherjesse/r8im/pkg/auth"
 	"github.com/anotherjesse/r8im/pkg/images"
 )
 
-func newZstdCommand() *cobra.Command {
+type zstdOptions struct {
+	*rootOptions
+	cache cacheOptions
+}
+
+func newZstdCommand(root *rootOptions) *cobra.Command {
+	o := &zstdOptions{rootOptions: root}
+
 	cmd := &cobra.Command{
 		Use:    "zstd <image> <dest>",
 		Short:  "recompress layers of an existing image using zstd, pushing result to dest",
 		Hidden: false,
 
-		RunE: zstdCommmand,
+		RunE: o.run,
 		Args: cobra.ExactArgs(2),
 	}
 
-	cmd.Flags().StringVarP(&sToken, "token", "t", "", "replicate cog token")
+	addCacheFlags(cmd, &o.cache)
+	addProgressFlags(cmd, root)
 
 	return cmd
 }
 
-func zstdCommmand(cmd *cobra.Command, args []string) error {
-	if sToken == "" {
-		sToken = os.Getenv("COG_TOKEN")
-	}
-
-	if len(args) == 0 {
-		return nil
-	}
-
-	u, err := auth.VerifyCogToken(sRegistry, sToken)
+func (o *zstdOptions) run(cmd *cobra.Command, args []string) error {
+	c, err := o.cache.open()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "authentication error, invalid token or registry host error")
 		return err
 	}
-	auth := authn.FromConfig(authn.AuthConfig{Username: u, Password: sToken})
 
 	imageName := args[0]
 	dest := args[1]
 
-	digest, err := images.Zstd(imageName, dest, auth)
+	opts, err := o.imageOptions(cmd, c, imageName, dest)
+	if err != nil {
+		return err
+	}
+
+	result, err := images.Zstd(imageName, dest, opts...)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(digest)
+	o.logTransfer(result.Transfer)
+
+	fmt.Println(result.Ref)
 
 	return nil
 }
@@ -2,112 +2,270 @@ package images
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"time"
 
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/crane"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/stream"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+	"github.com/anotherjesse/r8im/pkg/logging"
+	"github.com/anotherjesse/r8im/pkg/progress"
 )
 
 // FIXME(ja): the mediatypes of layers are tar.gzip? does that mean we should create weights as tar.gzip to go faster?
 
-func Affix(baseRef string, dest string, newLayer string, auth authn.Authenticator) (string, error) {
+// AffixResult describes an image pushed by Affix.
+type AffixResult struct {
+	// Ref is the pushed image, as dest@digest.
+	Ref    string
+	Digest v1.Hash
+	// WeightsLayers are the digests of the appended layers.
+	WeightsLayers []v1.Hash
+	// Delta lists the files changed by AffixDelta.
+	Delta *WeightsDelta
+	Transfer
+}
+
+// WeightsSplit says how AffixDir splits a weights directory into layers.
+// The zero value puts every file in one layer.
+type WeightsSplit struct {
+	// Layers is how many layers of about the same size to aim for.
+	Layers int
+	// LayerSize is the size to aim for per layer, in bytes. It takes
+	// precedence over Layers.
+	LayerSize int64
+}
+
+// Affix pushes baseRef to dest with the tar at newLayer appended as a new
+// weights layer. newLayer may be "-" to stream from stdin, or a directory
+// to append as by AffixDir in a single layer. Layers of baseRef are mounted
+// rather than uploaded when it is on the same registry as dest.
+func Affix(baseRef string, dest string, newLayer string, opts ...Option) (*AffixResult, error) {
+	if newLayer == "" {
+		return nil, fmt.Errorf("no layer to append")
+	}
+	if fi, err := os.Stat(newLayer); err == nil && fi.IsDir() {
+		return AffixDir(baseRef, dest, newLayer, WeightsSplit{}, opts...)
+	}
+
+	o := makeOptions(opts...)
+	logger := o.logger
 
 	var base v1.Image
 	var err error
 
-	fmt.Fprintln(os.Stderr, "fetching metadata for", baseRef)
+	logger.Info("fetching metadata", "image", baseRef)
 
 	start := time.Now()
-	base, err = crane.Pull(baseRef, crane.WithAuth(auth))
+	base, err = o.pull(baseRef)
 	if err != nil {
-		return "", fmt.Errorf("pulling %w", err)
+		return nil, fmt.Errorf("pulling %w", err)
 	}
-	fmt.Fprintln(os.Stderr, "pulling took", time.Since(start))
+	logger.Info("pulling took", "duration", time.Since(start))
 
 	// --- adding new layer ontop of existing image
 
-	var img v1.Image
+	logger.Info("appending as new layer", "tar", newLayer)
+
+	start = time.Now()
+	img, err := appendLayer(base, newLayer, o.progress)
+	if err != nil {
+		return nil, fmt.Errorf("appending %v: %w", newLayer, err)
+	}
+	logger.Info("appending took", "duration", time.Since(start))
+	// --- pushing image
 
-	if newLayer != "" {
-		fmt.Fprintln(os.Stderr, "appending as new layer", newLayer)
+	start = time.Now()
 
-		start = time.Now()
-		img, err = appendLayer(base, newLayer)
-		if err != nil {
-			return "", fmt.Errorf("appending %v: %w", newLayer, err)
-		}
-		fmt.Fprintln(os.Stderr, "appending took", time.Since(start))
-	} else {
-		cfg, err := base.ConfigFile()
-		if err != nil {
-			return "", fmt.Errorf("getting config file: %w", err)
-		}
+	transfer, err := o.push(img, dest)
+	if err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", dest, err)
+	}
 
-		cfg.Config.Labels["cloned"] = "true"
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
 
-		img, err = mutate.ConfigFile(base, cfg)
-		if err != nil {
-			return "", fmt.Errorf("mutating config file: %w", err)
-		}
+	d, err := img.Digest()
+	if err != nil {
+		return nil, err
 	}
-	// --- pushing image
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers %w", err)
+	}
+	weightsLayer, err := layers[len(layers)-1].Digest()
+	if err != nil {
+		return nil, err
+	}
+	image_id := fmt.Sprintf("%s@%s", dest, d)
+	return &AffixResult{Ref: image_id, Digest: d, WeightsLayers: []v1.Hash{weightsLayer}, Transfer: *transfer}, nil
+}
+
+// AffixDir pushes baseRef to dest with the files of dir appended as
+// weights under /src/weights, split into layers as split says. Each layer
+// gets its own weights history entry, and the tars only depend on the
+// files, so layers whose files are unchanged are reused from earlier
+// pushes and pulled in parallel.
+func AffixDir(baseRef string, dest string, dir string, split WeightsSplit, opts ...Option) (*AffixResult, error) {
+	o := makeOptions(opts...)
+	logger := o.logger
+
+	logger.Info("fetching metadata", "image", baseRef)
+
+	start := time.Now()
+	base, err := o.pull(baseRef)
+	if err != nil {
+		return nil, fmt.Errorf("pulling %w", err)
+	}
+	logger.Info("pulling took", "duration", time.Since(start))
+
+	shards, err := r8Layers.PlanShards(dir, split.Layers, split.LayerSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", dir, err)
+	}
+	logger.Info("appending directory as new layers", "dir", dir, "layers", len(shards))
+
+	start = time.Now()
+	img, digests, err := appendDir(base, dir, shards, logger)
+	if err != nil {
+		return nil, fmt.Errorf("appending %v: %w", dir, err)
+	}
+	logger.Info("appending took", "duration", time.Since(start))
 
 	start = time.Now()
 
-	err = crane.Push(img, dest, crane.WithAuth(auth))
+	transfer, err := o.push(img, dest)
 	if err != nil {
-		return "", fmt.Errorf("pushing %s: %w", dest, err)
+		return nil, fmt.Errorf("pushing %s: %w", dest, err)
 	}
 
-	fmt.Fprintln(os.Stderr, "pushing took", time.Since(start))
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
 
 	d, err := img.Digest()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	image_id := fmt.Sprintf("%s@%s", dest, d)
-	return image_id, nil
+	return &AffixResult{
+		Ref:           fmt.Sprintf("%s@%s", dest, d),
+		Digest:        d,
+		WeightsLayers: digests,
+		Transfer:      *transfer,
+	}, nil
 }
 
 // All of this code is from pkg/v1/mutate - so we can add history
 
-func appendLayer(base v1.Image, path string) (v1.Image, error) {
-	baseMediaType, err := base.MediaType()
+func appendLayer(base v1.Image, path string, p *progress.Reporter) (v1.Image, error) {
+	layerType, err := weightsLayerType(base)
 	if err != nil {
-		return nil, fmt.Errorf("getting base image media type: %w", err)
+		return nil, err
 	}
-	layerType := types.DockerLayer
 
-	if baseMediaType == types.OCIManifestSchema1 {
-		layerType = types.OCILayer
+	layer, files, err := getLayer(path, layerType, p)
+	if err != nil {
+		return nil, fmt.Errorf("reading layer %q: %w", path, err)
 	}
 
-	layers := make([]v1.Layer, 0, 1)
-	layer, err := getLayer(path, layerType)
+	img, err := appendLayers(base, layer)
 	if err != nil {
-		return nil, fmt.Errorf("reading layer %q: %w", path, err)
+		return nil, err
 	}
-	layers = append(layers, layer)
 
-	return appendLayers(base, layers...)
+	return withWeightsManifest(img, layer, files), nil
 }
 
-func getLayer(path string, layerType types.MediaType) (v1.Layer, error) {
+// appendDir appends a layer per shard of the files in dir to base, and
+// labels the result with their weights manifest.
+func appendDir(base v1.Image, dir string, shards []r8Layers.Shard, logger *logging.Logger) (v1.Image, []v1.Hash, error) {
+	layerType, err := weightsLayerType(base)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	layers := make([]v1.Layer, len(shards))
+	digests := make([]v1.Hash, len(shards))
+	var files []r8Layers.File
+	for i, shard := range shards {
+		if layers[i], err = shardLayer(dir, shard, layerType); err != nil {
+			return nil, nil, fmt.Errorf("building layer %d: %w", i, err)
+		}
+		if digests[i], err = layers[i].Digest(); err != nil {
+			return nil, nil, err
+		}
+		logger.Info("built weights layer", "layer", i, "files", len(shard.Files), "size", shard.Size, "digest", digests[i])
+
+		found, err := r8Layers.ShardFiles(dir, shard, digests[i].String())
+		if err != nil {
+			return nil, nil, fmt.Errorf("hashing weights: %w", err)
+		}
+		files = append(files, found...)
+	}
+
+	img, err := appendLayers(base, layers...)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err = labelWeights(img, files)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, digests, nil
+}
+
+// shardLayer makes a layer of the files of shard under dir.
+func shardLayer(dir string, shard r8Layers.Shard, layerType types.MediaType) (v1.Layer, error) {
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(r8Layers.WriteShard(pw, dir, shard))
+		}()
+		return pr, nil
+	}, tarball.WithMediaType(layerType))
+}
+
+// weightsLayerType returns the media type of layers added to base.
+func weightsLayerType(base v1.Image) (types.MediaType, error) {
+	baseMediaType, err := base.MediaType()
+	if err != nil {
+		return "", fmt.Errorf("getting base image media type: %w", err)
+	}
+	if baseMediaType == types.OCIManifestSchema1 {
+		return types.OCILayer, nil
+	}
+	return types.DockerLayer, nil
+}
+
+// getLayer returns the layer at path along with a function listing the
+// weights files in it. For streamed layers the files are hashed as the
+// layer is uploaded, and the function blocks until that has happened.
+func getLayer(path string, layerType types.MediaType, p *progress.Reporter) (v1.Layer, func() ([]r8Layers.File, error), error) {
 	f, err := streamFile(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if f != nil {
-		return stream.NewLayer(f, stream.WithMediaType(layerType)), nil
+		var total int64
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			total = fi.Size()
+		}
+		rc := p.Start("stream "+path, total).Reader(f)
+		recorder := r8Layers.NewWeightsRecorder(rc)
+		return stream.NewLayer(recorder, stream.WithMediaType(layerType)), recorder.Files, nil
 	}
 
-	return tarball.LayerFromFile(path, tarball.WithMediaType(layerType))
+	files, err := r8Layers.ScanWeights(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("hashing weights: %w", err)
+	}
+	layer, err := tarball.LayerFromFile(path, tarball.WithMediaType(layerType))
+	if err != nil {
+		return nil, nil, err
+	}
+	return layer, func() ([]r8Layers.File, error) { return files, nil }, nil
 }
 
 func streamFile(path string) (*os.File, error) {
@@ -0,0 +1,95 @@
+package images
+
+import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Ancestry describes the layers a set of images have in common.
+type Ancestry struct {
+	Images []AncestorImage `json:"images"`
+	// Shared are the leading layers all the images have in common,
+	// matched by diff_id, as found in the first image.
+	Shared []DiffLayer `json:"shared"`
+	// SamePlatform is false if the images are for different operating
+	// systems or architectures. Images that don't say match any.
+	SamePlatform bool `json:"samePlatform"`
+}
+
+// AncestorImage is one of the images compared by CommonAncestor.
+type AncestorImage struct {
+	Ref      string `json:"ref"`
+	Platform string `json:"platform"`
+	Layers   int    `json:"layers"`
+	// Diverges is the first layer of the image after the shared ones, or
+	// nil if the image has no other layers.
+	Diverges *DiffLayer `json:"diverges,omitempty"`
+}
+
+// CommonAncestor finds the longest prefix of layers that all of refs
+// share and where each of them diverges from it.
+func CommonAncestor(refs []string, opts ...Option) (*Ancestry, error) {
+	if len(refs) < 2 {
+		return nil, fmt.Errorf("need at least two images to compare, got %d", len(refs))
+	}
+
+	o := makeOptions(opts...)
+	imgs := make([]v1.Image, len(refs))
+	for i, ref := range refs {
+		o.logger.Info("fetching metadata", "image", ref)
+		img, err := o.pull(ref)
+		if err != nil {
+			return nil, fmt.Errorf("pulling %w", err)
+		}
+		imgs[i] = img
+	}
+	return ancestry(refs, imgs)
+}
+
+func ancestry(refs []string, imgs []v1.Image) (*Ancestry, error) {
+	a := &Ancestry{SamePlatform: true}
+	lists := make([][]DiffLayer, len(imgs))
+	var platform string
+	for i, img := range imgs {
+		layers, err := diffLayerList(img)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", refs[i], err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("getting config %w", err)
+		}
+		lists[i] = layers
+
+		// images without a platform, such as weights-only images, are
+		// taken to match any
+		var p string
+		if cfg.OS != "" || cfg.Architecture != "" {
+			p = cfg.OS + "/" + cfg.Architecture
+		}
+		if platform == "" {
+			platform = p
+		} else if p != "" && p != platform {
+			a.SamePlatform = false
+		}
+		a.Images = append(a.Images, AncestorImage{Ref: refs[i], Platform: p, Layers: len(layers)})
+	}
+
+	shared := len(lists[0])
+	for _, layers := range lists[1:] {
+		n := 0
+		for n < shared && n < len(layers) && layers[n].DiffID == lists[0][n].DiffID {
+			n++
+		}
+		shared = n
+	}
+	a.Shared = append([]DiffLayer{}, lists[0][:shared]...)
+
+	for i, layers := range lists {
+		if shared < len(layers) {
+			a.Images[i].Diverges = &layers[shared]
+		}
+	}
+	return a, nil
+}
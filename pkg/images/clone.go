@@ -0,0 +1,95 @@
+package images
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// CloneResult describes an image copied by Clone.
+type CloneResult struct {
+	// Ref is the pushed image, as dest@digest.
+	Ref    string
+	Digest v1.Hash
+	Transfer
+}
+
+// Clone copies src to dest. Without label edits the manifest is copied
+// byte for byte, so the digest stays the same, and an index is copied with
+// all its images unless WithPlatform picks one. With edits the config is
+// rewritten, which changes the digest, and only one image of an index is
+// copied. Blobs are mounted rather than uploaded when src and dest are on
+// the same registry.
+func Clone(src string, dest string, labels LabelEdit, opts ...Option) (*CloneResult, error) {
+	o := makeOptions(opts...)
+	logger := o.logger
+
+	srcRef, err := name.ParseReference(src, o.nameOptions(src)...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing reference %q: %w", src, err)
+	}
+
+	logger.Info("fetching metadata", "image", src)
+
+	start := time.Now()
+	craneOpts, err := o.crane(src)
+	if err != nil {
+		return nil, fmt.Errorf("pulling %w", pullError(err))
+	}
+	desc, err := remote.Get(srcRef, crane.GetOptions(craneOpts...).Remote...)
+	if err != nil {
+		return nil, fmt.Errorf("pulling %w", pullError(err))
+	}
+	logger.Info("pulling took", "duration", time.Since(start))
+
+	var d v1.Hash
+	var transfer *Transfer
+
+	start = time.Now()
+	if desc.MediaType.IsIndex() && o.platform == nil && labels.Empty() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		transfer, err = o.pushIndex(idx, dest)
+		if err != nil {
+			return nil, fmt.Errorf("pushing %s: %w", dest, err)
+		}
+		d = desc.Digest
+	} else {
+		// for an index this picks the image for the platform, linux/amd64
+		// unless WithPlatform says otherwise
+		img, err := desc.Image()
+		if err != nil {
+			return nil, fmt.Errorf("pulling %w", pullError(err))
+		}
+		if !labels.Empty() {
+			img, err = mutateConfig(img, func(cfg *v1.ConfigFile) error {
+				cfg.Config.Labels = labels.apply(cfg.Config.Labels)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		transfer, err = o.push(img, dest)
+		if err != nil {
+			return nil, fmt.Errorf("pushing %s: %w", dest, err)
+		}
+		d, err = img.Digest()
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
+
+	return &CloneResult{
+		Ref:      fmt.Sprintf("%s@%s", dest, d),
+		Digest:   d,
+		Transfer: *transfer,
+	}, nil
+}
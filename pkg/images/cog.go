@@ -0,0 +1,229 @@
+package images
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Labels cog stores in the config of the images it builds.
+const (
+	CogConfigLabel        = "run.cog.config"
+	CogOpenAPISchemaLabel = "run.cog.openapi_schema"
+	CogVersionLabel       = "run.cog.version"
+
+	cogLabelPrefix = "run.cog."
+)
+
+// legacyCogLabels maps the labels written by cog before 0.7 to their
+// current names.
+var legacyCogLabels = map[string]string{
+	"org.cogmodel.config":         CogConfigLabel,
+	"org.cogmodel.openapi_schema": CogOpenAPISchemaLabel,
+	"org.cogmodel.cog_version":    CogVersionLabel,
+}
+
+// ErrInvalidCogLabels is returned when the cog labels of an image are
+// missing or don't parse.
+var ErrInvalidCogLabels = errors.New("invalid cog labels")
+
+// CogLabels are the cog labels of an image, decoded.
+type CogLabels struct {
+	// Version is the version of cog that built the image.
+	Version string `json:"version,omitempty"`
+	// Config is cog.yaml, as JSON.
+	Config json.RawMessage `json:"config,omitempty"`
+	// OpenAPISchema is the schema of the predictor's inputs and outputs.
+	OpenAPISchema json.RawMessage `json:"openapi_schema,omitempty"`
+	// Other holds the remaining run.cog.* labels as they are.
+	Other map[string]string `json:"other,omitempty"`
+}
+
+// CogLabelsFromConfig picks the cog labels out of the labels of an image
+// config, falling back to the names older cogs used.
+func CogLabelsFromConfig(labels map[string]string) *CogLabels {
+	get := func(label string) string {
+		if v, ok := labels[label]; ok {
+			return v
+		}
+		for old, current := range legacyCogLabels {
+			if current == label {
+				return labels[old]
+			}
+		}
+		return ""
+	}
+
+	l := &CogLabels{Version: get(CogVersionLabel)}
+	if v := get(CogConfigLabel); v != "" {
+		l.Config = json.RawMessage(v)
+	}
+	if v := get(CogOpenAPISchemaLabel); v != "" {
+		l.OpenAPISchema = json.RawMessage(v)
+	}
+	for k, v := range labels {
+		switch k {
+		case CogConfigLabel, CogOpenAPISchemaLabel, CogVersionLabel:
+			continue
+		}
+		if strings.HasPrefix(k, cogLabelPrefix) {
+			if l.Other == nil {
+				l.Other = map[string]string{}
+			}
+			l.Other[k] = v
+		}
+	}
+	return l
+}
+
+// ReadCogLabels fetches the config of imageName and returns its cog labels.
+func ReadCogLabels(imageName string, opts ...Option) (*CogLabels, error) {
+	o := makeOptions(opts...)
+	cfg, err := o.config(imageName)
+	if err != nil {
+		return nil, err
+	}
+	return CogLabelsFromConfig(cfg.Config.Labels), nil
+}
+
+// Problems lists what is wrong with l: missing labels, JSON that doesn't
+// parse and a schema without the predictor's Input and Output.
+func (l *CogLabels) Problems() []string {
+	var problems []string
+	if l.Version == "" {
+		problems = append(problems, CogVersionLabel+" is missing")
+	}
+
+	var config map[string]interface{}
+	if len(l.Config) == 0 {
+		problems = append(problems, CogConfigLabel+" is missing")
+	} else if err := json.Unmarshal(l.Config, &config); err != nil {
+		problems = append(problems, fmt.Sprintf("%s is not a JSON object: %v", CogConfigLabel, err))
+	}
+
+	var schema struct {
+		OpenAPI    string `json:"openapi"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if len(l.OpenAPISchema) == 0 {
+		problems = append(problems, CogOpenAPISchemaLabel+" is missing")
+	} else if err := json.Unmarshal(l.OpenAPISchema, &schema); err != nil {
+		problems = append(problems, fmt.Sprintf("%s is not a JSON object: %v", CogOpenAPISchemaLabel, err))
+	} else {
+		if schema.OpenAPI == "" {
+			problems = append(problems, CogOpenAPISchemaLabel+" has no openapi version")
+		}
+		for _, s := range []string{"Input", "Output"} {
+			if _, ok := schema.Components.Schemas[s]; !ok {
+				problems = append(problems, fmt.Sprintf("%s has no components.schemas.%s", CogOpenAPISchemaLabel, s))
+			}
+		}
+	}
+	return problems
+}
+
+// Validate returns an error wrapping ErrInvalidCogLabels listing the
+// problems with l, if any.
+func (l *CogLabels) Validate() error {
+	problems := l.Problems()
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidCogLabels, strings.Join(problems, "; "))
+}
+
+// Edit returns the label edit that stores the non-empty fields of l in an
+// image config. JSON is compacted, as cog writes it, and labels under their
+// pre-0.7 names are removed so they can't shadow the new values.
+func (l *CogLabels) Edit() (LabelEdit, error) {
+	edit := LabelEdit{Set: map[string]string{}}
+	set := func(label string, v string) {
+		edit.Set[label] = v
+		for old, current := range legacyCogLabels {
+			if current == label {
+				edit.Remove = append(edit.Remove, old)
+			}
+		}
+	}
+
+	if l.Version != "" {
+		set(CogVersionLabel, l.Version)
+	}
+	for _, f := range []struct {
+		label string
+		raw   json.RawMessage
+	}{
+		{CogConfigLabel, l.Config},
+		{CogOpenAPISchemaLabel, l.OpenAPISchema},
+	} {
+		if len(f.raw) == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, f.raw); err != nil {
+			return LabelEdit{}, fmt.Errorf("%w: %s: %v", ErrInvalidCogLabels, f.label, err)
+		}
+		set(f.label, buf.String())
+	}
+	for k, v := range l.Other {
+		set(k, v)
+	}
+	sort.Strings(edit.Remove)
+	return edit, nil
+}
+
+// CogConfigFromYAML converts cog.yaml to the JSON cog stores in the
+// run.cog.config label.
+func CogConfigFromYAML(b []byte) (json.RawMessage, error) {
+	var v map[string]interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, fmt.Errorf("parsing cog.yaml: %w", err)
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("converting cog.yaml to JSON: %w", err)
+	}
+	return out, nil
+}
+
+// DiffCogLabels compares the cog labels of two images field by field.
+// Paths start with the label's field in CogLabels, such as
+// "config.build.python_version". Labels that aren't valid JSON are
+// compared as strings.
+func DiffCogLabels(a, b *CogLabels) []FieldChange {
+	return diffJSON("", a.Decoded(), b.Decoded())
+}
+
+// Decoded returns l as a JSON document with the labels decoded, keeping
+// any that aren't valid JSON as strings.
+func (l *CogLabels) Decoded() map[string]interface{} {
+	doc := map[string]interface{}{}
+	if l.Version != "" {
+		doc["version"] = l.Version
+	}
+	for k, raw := range map[string]json.RawMessage{"config": l.Config, "openapi_schema": l.OpenAPISchema} {
+		if len(raw) == 0 {
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			v = string(raw)
+		}
+		doc[k] = v
+	}
+	if len(l.Other) > 0 {
+		other := make(map[string]interface{}, len(l.Other))
+		for k, v := range l.Other {
+			other[k] = v
+		}
+		doc["other"] = other
+	}
+	return doc
+}
@@ -0,0 +1,318 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// LabelEdit changes the labels in an image config. Remove is applied
+// before Set.
+type LabelEdit struct {
+	Set    map[string]string
+	Remove []string
+}
+
+// Empty reports whether e changes nothing.
+func (e LabelEdit) Empty() bool {
+	return len(e.Set) == 0 && len(e.Remove) == 0
+}
+
+// apply returns labels with e applied, leaving labels itself untouched.
+func (e LabelEdit) apply(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels)+len(e.Set))
+	for k, v := range labels {
+		out[k] = v
+	}
+	for _, k := range e.Remove {
+		delete(out, k)
+	}
+	for k, v := range e.Set {
+		out[k] = v
+	}
+	return out
+}
+
+// ConfigEdit changes the runtime settings in an image config. Zero fields
+// are left alone; removals are applied before additions.
+type ConfigEdit struct {
+	Labels LabelEdit
+
+	// SetEnv sets environment variables, replacing existing values in
+	// place and appending new ones in key order.
+	SetEnv   map[string]string
+	UnsetEnv []string
+
+	// Entrypoint and Cmd replace the existing ones when not nil. An empty
+	// slice clears them.
+	Entrypoint []string
+	Cmd        []string
+
+	WorkingDir *string
+	User       *string
+	StopSignal *string
+
+	// Expose and Unexpose are ports such as "8080" or "53/udp". Ports
+	// without a protocol are tcp.
+	Expose   []string
+	Unexpose []string
+}
+
+// Empty reports whether e changes nothing.
+func (e ConfigEdit) Empty() bool {
+	return e.Labels.Empty() &&
+		len(e.SetEnv) == 0 && len(e.UnsetEnv) == 0 &&
+		e.Entrypoint == nil && e.Cmd == nil &&
+		e.WorkingDir == nil && e.User == nil && e.StopSignal == nil &&
+		len(e.Expose) == 0 && len(e.Unexpose) == 0
+}
+
+// String describes e in Dockerfile terms, for the history entry.
+func (e ConfigEdit) String() string {
+	var parts []string
+	for _, k := range e.Labels.Remove {
+		parts = append(parts, "UNSET LABEL "+k)
+	}
+	for _, k := range sortedKeys(e.Labels.Set) {
+		parts = append(parts, fmt.Sprintf("LABEL %s=%s", k, strconv.Quote(abbreviate(e.Labels.Set[k]))))
+	}
+	for _, k := range e.UnsetEnv {
+		parts = append(parts, "UNSET ENV "+k)
+	}
+	for _, k := range sortedKeys(e.SetEnv) {
+		parts = append(parts, fmt.Sprintf("ENV %s=%s", k, strconv.Quote(abbreviate(e.SetEnv[k]))))
+	}
+	if e.Entrypoint != nil {
+		parts = append(parts, "ENTRYPOINT "+jsonArray(e.Entrypoint))
+	}
+	if e.Cmd != nil {
+		parts = append(parts, "CMD "+jsonArray(e.Cmd))
+	}
+	if e.WorkingDir != nil {
+		parts = append(parts, "WORKDIR "+*e.WorkingDir)
+	}
+	if e.User != nil {
+		parts = append(parts, "USER "+*e.User)
+	}
+	for _, p := range e.Unexpose {
+		parts = append(parts, "UNEXPOSE "+p)
+	}
+	for _, p := range e.Expose {
+		parts = append(parts, "EXPOSE "+p)
+	}
+	if e.StopSignal != nil {
+		parts = append(parts, "STOPSIGNAL "+*e.StopSignal)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// abbreviate shortens long values, such as cog's OpenAPI schema label, so
+// that they don't bloat the history.
+func abbreviate(v string) string {
+	const maxLen = 64
+	if len(v) <= maxLen {
+		return v
+	}
+	return fmt.Sprintf("%s... (%d bytes)", v[:maxLen], len(v))
+}
+
+// apply applies e to cfg.
+func (e ConfigEdit) apply(cfg *v1.Config) error {
+	if !e.Labels.Empty() {
+		cfg.Labels = e.Labels.apply(cfg.Labels)
+	}
+	if len(e.SetEnv) > 0 || len(e.UnsetEnv) > 0 {
+		cfg.Env = editEnv(cfg.Env, e.SetEnv, e.UnsetEnv)
+	}
+	if e.Entrypoint != nil {
+		cfg.Entrypoint = e.Entrypoint
+	}
+	if e.Cmd != nil {
+		cfg.Cmd = e.Cmd
+	}
+	if e.WorkingDir != nil {
+		cfg.WorkingDir = *e.WorkingDir
+	}
+	if e.User != nil {
+		cfg.User = *e.User
+	}
+	if e.StopSignal != nil {
+		cfg.StopSignal = *e.StopSignal
+	}
+
+	if len(e.Expose) > 0 || len(e.Unexpose) > 0 {
+		ports := make(map[string]struct{}, len(cfg.ExposedPorts)+len(e.Expose))
+		for p := range cfg.ExposedPorts {
+			ports[p] = struct{}{}
+		}
+		for _, p := range e.Unexpose {
+			p, err := normalizePort(p)
+			if err != nil {
+				return err
+			}
+			delete(ports, p)
+		}
+		for _, p := range e.Expose {
+			p, err := normalizePort(p)
+			if err != nil {
+				return err
+			}
+			ports[p] = struct{}{}
+		}
+		cfg.ExposedPorts = ports
+	}
+	return nil
+}
+
+// editEnv returns env, a list of KEY=VALUE, with unset removed and set
+// applied.
+func editEnv(env []string, set map[string]string, unset []string) []string {
+	drop := make(map[string]bool, len(unset))
+	for _, k := range unset {
+		drop[k] = true
+	}
+	done := make(map[string]bool, len(set))
+
+	out := make([]string, 0, len(env)+len(set))
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		if drop[k] {
+			continue
+		}
+		if v, ok := set[k]; ok {
+			kv = k + "=" + v
+			done[k] = true
+		}
+		out = append(out, kv)
+	}
+	for _, k := range sortedKeys(set) {
+		if !done[k] {
+			out = append(out, k+"="+set[k])
+		}
+	}
+	return out
+}
+
+// normalizePort returns p as port/protocol.
+func normalizePort(p string) (string, error) {
+	port, proto, ok := strings.Cut(p, "/")
+	if !ok {
+		proto = "tcp"
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q", p)
+	}
+	switch proto = strings.ToLower(proto); proto {
+	case "tcp", "udp", "sctp":
+	default:
+		return "", fmt.Errorf("invalid port %q: unknown protocol %q", p, proto)
+	}
+	return fmt.Sprintf("%d/%s", n, proto), nil
+}
+
+// ConfigResult describes an image pushed by EditConfig.
+type ConfigResult struct {
+	// Ref is the pushed image, as dest@digest.
+	Ref    string
+	Digest v1.Hash
+	Transfer
+}
+
+// EditConfig applies edit to the config of src and pushes the result to
+// dest. The layers are left untouched, and an empty history entry
+// describing the change is appended.
+func EditConfig(src string, dest string, edit ConfigEdit, opts ...Option) (*ConfigResult, error) {
+	if edit.Empty() {
+		return nil, fmt.Errorf("no config changes")
+	}
+	// catch invalid ports before pulling anything
+	if err := edit.apply(&v1.Config{}); err != nil {
+		return nil, err
+	}
+
+	o := makeOptions(opts...)
+	logger := o.logger
+
+	logger.Info("fetching metadata", "image", src)
+
+	start := time.Now()
+	base, err := o.pull(src)
+	if err != nil {
+		return nil, fmt.Errorf("pulling %w", err)
+	}
+	logger.Info("pulling took", "duration", time.Since(start))
+
+	img, err := mutateConfig(base, func(cfg *v1.ConfigFile) error {
+		if err := edit.apply(&cfg.Config); err != nil {
+			return err
+		}
+		cfg.History = append(cfg.History, v1.History{
+			CreatedBy:  edit.String(),
+			Created:    v1.Time{Time: time.Now()},
+			Author:     "r8im",
+			Comment:    "config",
+			EmptyLayer: true,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	transfer, err := o.push(img, dest)
+	if err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", dest, err)
+	}
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
+
+	d, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigResult{
+		Ref:      fmt.Sprintf("%s@%s", dest, d),
+		Digest:   d,
+		Transfer: *transfer,
+	}, nil
+}
+
+// mutateConfig returns img with its config changed by edit, which is given
+// a copy to modify.
+func mutateConfig(img v1.Image, edit func(*v1.ConfigFile) error) (v1.Image, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting config file: %w", err)
+	}
+	cfg = cfg.DeepCopy()
+	if err := edit(cfg); err != nil {
+		return nil, err
+	}
+
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("mutating config file: %w", err)
+	}
+	return img, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func jsonArray(s []string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
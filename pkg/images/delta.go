@@ -0,0 +1,170 @@
+package images
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+	"github.com/anotherjesse/r8im/pkg/logging"
+)
+
+// WeightsDelta lists the weights files a delta layer changes, relative to
+// /src/weights.
+type WeightsDelta struct {
+	// Changed are the files added or modified.
+	Changed []string
+	// Removed are the files the layer deletes with whiteouts.
+	Removed []string
+	// Layer is the digest of the delta layer.
+	Layer v1.Hash
+}
+
+// AffixDelta pushes baseRef to dest with a layer holding only the files of
+// dir that differ from the weights already in baseRef, and whiteouts for
+// the files dir no longer has. The weights of baseRef are listed from
+// manifest, such as one written by extract, or with WeightsManifest if it
+// is nil; manifest may only list files in layers of baseRef, as
+// checkManifest checks. The weights
+// manifest label of the result lists every file.
+func AffixDelta(baseRef string, dest string, dir string, manifest *r8Layers.Manifest, opts ...Option) (*AffixResult, error) {
+	o := makeOptions(opts...)
+	logger := o.logger
+
+	logger.Info("fetching metadata", "image", baseRef)
+
+	start := time.Now()
+	base, err := o.pull(baseRef)
+	if err != nil {
+		return nil, fmt.Errorf("pulling %w", err)
+	}
+	logger.Info("pulling took", "duration", time.Since(start))
+
+	if manifest == nil {
+		if manifest, err = WeightsManifest(baseRef, opts...); err != nil {
+			return nil, err
+		}
+	} else if err := checkManifest(manifest, baseRef, base); err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	img, delta, err := appendDelta(base, dir, manifest, logger)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("appending delta took", "duration", time.Since(start))
+
+	start = time.Now()
+
+	transfer, err := o.push(img, dest)
+	if err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", dest, err)
+	}
+
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
+
+	d, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &AffixResult{
+		Ref:           fmt.Sprintf("%s@%s", dest, d),
+		Digest:        d,
+		WeightsLayers: []v1.Hash{delta.Layer},
+		Delta:         delta,
+		Transfer:      *transfer,
+	}, nil
+}
+
+// checkManifest returns an error wrapping ErrManifestMismatch unless every
+// file m lists is in a layer of img, the image ref points at now, so a
+// delta isn't made against weights img doesn't have. The name m records
+// isn't enough, as a tag may have moved since m was written.
+func checkManifest(m *r8Layers.Manifest, ref string, img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(layers))
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			return err
+		}
+		have[d.String()] = true
+	}
+	for _, f := range m.Files {
+		if !have[f.Layer] {
+			return fmt.Errorf("%w: %s lists %s in layer %q, which %s doesn't have", ErrManifestMismatch, m.Image, f.Path, f.Layer, ref)
+		}
+	}
+	return nil
+}
+
+// appendDelta appends to img a layer with the files of dir that differ from
+// old, and whiteouts for the files of old that dir doesn't have, and labels
+// the result with the weights manifest of both together.
+func appendDelta(img v1.Image, dir string, old *r8Layers.Manifest, logger *logging.Logger) (v1.Image, *WeightsDelta, error) {
+	logger.Info("comparing weights", "dir", dir, "files", len(old.Files))
+	report, err := r8Layers.VerifyDir(dir, old)
+	if err != nil {
+		return nil, nil, fmt.Errorf("comparing %s: %w", dir, err)
+	}
+
+	delta := &WeightsDelta{Changed: append([]string{}, report.Extra...), Removed: []string{}}
+	for _, m := range report.Corrupted {
+		delta.Changed = append(delta.Changed, m.Expected.Path)
+	}
+	for _, f := range report.Missing {
+		delta.Removed = append(delta.Removed, f.Path)
+	}
+	sort.Strings(delta.Changed)
+	sort.Strings(delta.Removed)
+	if len(delta.Changed) == 0 && len(delta.Removed) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s matches the %d files of %s", ErrWeightsUnchanged, dir, len(old.Files), old.Image)
+	}
+	logger.Info("found weights changes", "changed", len(delta.Changed), "removed", len(delta.Removed), "unchanged", report.Matched)
+
+	layerType, err := weightsLayerType(img)
+	if err != nil {
+		return nil, nil, err
+	}
+	shard := r8Layers.Shard{Files: delta.Changed, Deleted: delta.Removed}
+	layer, err := shardLayer(dir, shard, layerType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("building delta layer: %w", err)
+	}
+	if delta.Layer, err = layer.Digest(); err != nil {
+		return nil, nil, err
+	}
+	logger.Info("built delta layer", "digest", delta.Layer)
+
+	changed, err := r8Layers.ShardFiles(dir, shard, delta.Layer.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("hashing weights: %w", err)
+	}
+	gone := make(map[string]bool, len(delta.Changed)+len(delta.Removed))
+	for _, p := range append(delta.Changed, delta.Removed...) {
+		gone[p] = true
+	}
+	var files []r8Layers.File
+	for _, f := range old.Files {
+		if !gone[f.Path] {
+			files = append(files, f)
+		}
+	}
+	files = append(files, changed...)
+
+	img, err = appendLayers(img, layer)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err = labelWeights(img, files)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, delta, nil
+}
@@ -0,0 +1,464 @@
+package images
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+// Kinds of change reported by Diff.
+const (
+	ChangeAdded        = "added"
+	ChangeRemoved      = "removed"
+	ChangeModified     = "modified"
+	ChangeMoved        = "moved"
+	ChangeRecompressed = "recompressed"
+)
+
+// ImageDiff describes how image B differs from image A.
+type ImageDiff struct {
+	A string `json:"a"`
+	B string `json:"b"`
+	// Config lists changed config fields, leaving out the history and
+	// rootfs, which are covered by History and Layers.
+	Config  []FieldChange   `json:"config"`
+	Layers  []LayerChange   `json:"layers"`
+	History []HistoryChange `json:"history"`
+	// Files is only filled in when Diff is asked to compare the merged
+	// filesystems.
+	Files []FileChange `json:"files,omitempty"`
+}
+
+// Empty reports whether the images were found to be the same.
+func (d *ImageDiff) Empty() bool {
+	return len(d.Config) == 0 && len(d.Layers) == 0 && len(d.History) == 0 && len(d.Files) == 0
+}
+
+// FieldChange is a difference between two JSON documents. A is missing
+// when the field was added, B when it was removed.
+type FieldChange struct {
+	// Path is the field, as dotted keys and [index]es.
+	Path string      `json:"path"`
+	A    interface{} `json:"a,omitempty"`
+	B    interface{} `json:"b,omitempty"`
+}
+
+// DiffLayer is a layer of one of the images compared by Diff.
+type DiffLayer struct {
+	Index     int             `json:"index"`
+	Digest    v1.Hash         `json:"digest"`
+	DiffID    v1.Hash         `json:"diffId"`
+	Size      int64           `json:"size"`
+	MediaType types.MediaType `json:"mediaType"`
+	CreatedBy string          `json:"createdBy,omitempty"`
+}
+
+// LayerChange is a layer only in A (removed), only in B (added), at a
+// different position (moved) or with the same contents but a different
+// digest (recompressed). Layers are matched by diff_id.
+type LayerChange struct {
+	Change string     `json:"change"`
+	A      *DiffLayer `json:"a,omitempty"`
+	B      *DiffLayer `json:"b,omitempty"`
+}
+
+// HistoryChange is a history entry only in A (removed) or only in B
+// (added).
+type HistoryChange struct {
+	Change  string     `json:"change"`
+	Index   int        `json:"index"`
+	History v1.History `json:"history"`
+}
+
+// FileChange is a file of the merged filesystem only in A (removed), only
+// in B (added), or in both with different contents, type or mode
+// (modified).
+type FileChange struct {
+	Change string `json:"change"`
+	Path   string `json:"path"`
+	SizeA  int64  `json:"sizeA,omitempty"`
+	SizeB  int64  `json:"sizeB,omitempty"`
+}
+
+// Diff compares the images a and b. With files set the merged filesystem
+// of both images is read, through the cache, and compared file by file,
+// which means downloading every layer.
+func Diff(a string, b string, files bool, opts ...Option) (*ImageDiff, error) {
+	o := makeOptions(opts...)
+	logger := o.logger
+
+	var imgs [2]v1.Image
+	var cfgs [2]*v1.ConfigFile
+	for i, ref := range []string{a, b} {
+		logger.Info("fetching metadata", "image", ref)
+		img, err := o.pull(ref)
+		if err != nil {
+			return nil, fmt.Errorf("pulling %w", err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("getting config %w", err)
+		}
+		imgs[i] = o.cache.Image(o.progress.Image(img))
+		cfgs[i] = cfg
+	}
+
+	d := &ImageDiff{A: a, B: b}
+
+	var err error
+	if d.Config, err = diffConfig(cfgs[0], cfgs[1]); err != nil {
+		return nil, err
+	}
+	if d.Layers, err = diffLayers(imgs[0], imgs[1]); err != nil {
+		return nil, err
+	}
+	d.History = diffHistory(cfgs[0].History, cfgs[1].History)
+
+	// empty lists rather than null for JSON consumers
+	if d.Config == nil {
+		d.Config = []FieldChange{}
+	}
+	if d.Layers == nil {
+		d.Layers = []LayerChange{}
+	}
+	if d.History == nil {
+		d.History = []HistoryChange{}
+	}
+
+	if files {
+		start := time.Now()
+		var trees [2]map[string]fileEntry
+		for i, img := range imgs {
+			logger.Info("reading filesystem", "image", []string{a, b}[i])
+			if trees[i], err = readTree(o.ctx, img); err != nil {
+				return nil, err
+			}
+		}
+		d.Files = diffTrees(trees[0], trees[1])
+		logger.Info("comparing files took", "duration", time.Since(start))
+	}
+
+	return d, nil
+}
+
+// diffConfig compares the configs, leaving out the history and rootfs.
+func diffConfig(a, b *v1.ConfigFile) ([]FieldChange, error) {
+	var docs [2]interface{}
+	for i, cfg := range []*v1.ConfigFile{a, b} {
+		cfg = cfg.DeepCopy()
+		cfg.History = nil
+		cfg.RootFS = v1.RootFS{}
+		raw, err := json.Marshal(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &docs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return diffJSON("", docs[0], docs[1]), nil
+}
+
+// diffLayers matches the layers of a and b by diff_id, keeping as many as
+// possible in order; matched layers out of order are reported as moved.
+func diffLayers(a, b v1.Image) ([]LayerChange, error) {
+	la, err := diffLayerList(a)
+	if err != nil {
+		return nil, err
+	}
+	lb, err := diffLayerList(b)
+	if err != nil {
+		return nil, err
+	}
+
+	ka := make([]string, len(la))
+	for i, l := range la {
+		ka[i] = l.DiffID.String()
+	}
+	kb := make([]string, len(lb))
+	for i, l := range lb {
+		kb[i] = l.DiffID.String()
+	}
+	ma, mb := lcs(ka, kb)
+
+	var changes []LayerChange
+	for i, j := range ma {
+		if j >= 0 && la[i].Digest != lb[j].Digest {
+			changes = append(changes, LayerChange{Change: ChangeRecompressed, A: &la[i], B: &lb[j]})
+		}
+	}
+
+	// layers left over on both sides with the same contents were moved
+	unmatched := map[string][]int{}
+	for j, i := range mb {
+		if i < 0 {
+			unmatched[kb[j]] = append(unmatched[kb[j]], j)
+		}
+	}
+	for i, j := range ma {
+		if j >= 0 {
+			continue
+		}
+		if js := unmatched[ka[i]]; len(js) > 0 {
+			j = js[0]
+			unmatched[ka[i]] = js[1:]
+			mb[j] = i
+			changes = append(changes, LayerChange{Change: ChangeMoved, A: &la[i], B: &lb[j]})
+			continue
+		}
+		changes = append(changes, LayerChange{Change: ChangeRemoved, A: &la[i]})
+	}
+	for j, i := range mb {
+		if i < 0 {
+			changes = append(changes, LayerChange{Change: ChangeAdded, B: &lb[j]})
+		}
+	}
+	return changes, nil
+}
+
+func diffLayerList(img v1.Image) ([]DiffLayer, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest %w", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting config %w", err)
+	}
+	if len(cfg.RootFS.DiffIDs) != len(m.Layers) {
+		return nil, fmt.Errorf("%w: config has %d diff_ids for %d layers", ErrHistoryMismatch, len(cfg.RootFS.DiffIDs), len(m.Layers))
+	}
+
+	var createdBy []string
+	for _, h := range cfg.History {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+
+	layers := make([]DiffLayer, len(m.Layers))
+	for i, desc := range m.Layers {
+		layers[i] = DiffLayer{
+			Index:     i,
+			Digest:    desc.Digest,
+			DiffID:    cfg.RootFS.DiffIDs[i],
+			Size:      desc.Size,
+			MediaType: desc.MediaType,
+		}
+		if len(createdBy) == len(m.Layers) {
+			layers[i].CreatedBy = createdBy[i]
+		}
+	}
+	return layers, nil
+}
+
+// diffHistory compares history entries by what created them, ignoring
+// timestamps.
+func diffHistory(a, b []v1.History) []HistoryChange {
+	key := func(h v1.History) string {
+		return h.CreatedBy + "\x00" + h.Comment + "\x00" + strconv.FormatBool(h.EmptyLayer)
+	}
+	ka := make([]string, len(a))
+	for i, h := range a {
+		ka[i] = key(h)
+	}
+	kb := make([]string, len(b))
+	for i, h := range b {
+		kb[i] = key(h)
+	}
+	ma, mb := lcs(ka, kb)
+
+	var changes []HistoryChange
+	for i, j := range ma {
+		if j < 0 {
+			changes = append(changes, HistoryChange{Change: ChangeRemoved, Index: i, History: a[i]})
+		}
+	}
+	for j, i := range mb {
+		if i < 0 {
+			changes = append(changes, HistoryChange{Change: ChangeAdded, Index: j, History: b[j]})
+		}
+	}
+	return changes
+}
+
+// lcs finds a longest common subsequence of a and b. It returns, for each
+// element of a, the index of the element of b it is matched with, or -1,
+// and the same for b.
+func lcs(a, b []string) ([]int, []int) {
+	// n[i][j] is the length of the LCS of a[i:] and b[j:]
+	n := make([][]int, len(a)+1)
+	for i := range n {
+		n[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				n[i][j] = n[i+1][j+1] + 1
+			case n[i+1][j] >= n[i][j+1]:
+				n[i][j] = n[i+1][j]
+			default:
+				n[i][j] = n[i][j+1]
+			}
+		}
+	}
+
+	ma := make([]int, len(a))
+	for i := range ma {
+		ma[i] = -1
+	}
+	mb := make([]int, len(b))
+	for j := range mb {
+		mb[j] = -1
+	}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			ma[i], mb[j] = j, i
+			i++
+			j++
+		case n[i+1][j] >= n[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return ma, mb
+}
+
+// fileEntry is what diffTrees compares about a file.
+type fileEntry struct {
+	typeflag byte
+	mode     int64
+	size     int64
+	linkname string
+	sum      [sha256.Size]byte
+}
+
+// readTree reads the merged filesystem of img, hashing regular files.
+func readTree(ctx context.Context, img v1.Image) (map[string]fileEntry, error) {
+	rc := mutate.Extract(img)
+	defer rc.Close()
+
+	tree := map[string]fileEntry{}
+	tr := tar.NewReader(r8Layers.WithContext(ctx, rc))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return tree, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading filesystem: %w", err)
+		}
+
+		e := fileEntry{
+			typeflag: hdr.Typeflag,
+			mode:     hdr.Mode,
+			size:     hdr.Size,
+			linkname: hdr.Linkname,
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", hdr.Name, err)
+			}
+			copy(e.sum[:], h.Sum(nil))
+		}
+		tree[path.Clean("/"+hdr.Name)] = e
+	}
+}
+
+func diffTrees(a, b map[string]fileEntry) []FileChange {
+	var changes []FileChange
+	for p, ea := range a {
+		eb, ok := b[p]
+		switch {
+		case !ok:
+			changes = append(changes, FileChange{Change: ChangeRemoved, Path: p, SizeA: ea.size})
+		case ea != eb:
+			changes = append(changes, FileChange{Change: ChangeModified, Path: p, SizeA: ea.size, SizeB: eb.size})
+		}
+	}
+	for p, eb := range b {
+		if _, ok := a[p]; !ok {
+			changes = append(changes, FileChange{Change: ChangeAdded, Path: p, SizeB: eb.size})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// diffJSON compares two decoded JSON values, descending into objects and
+// arrays.
+func diffJSON(path string, a, b interface{}) []FieldChange {
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "." + k
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := map[string]bool{}
+		for k := range av {
+			keys[k] = true
+		}
+		for k := range bv {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		var changes []FieldChange
+		for _, k := range sorted {
+			changes = append(changes, diffJSON(join(k), av[k], bv[k])...)
+		}
+		return changes
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		var changes []FieldChange
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			var x, y interface{}
+			if i < len(av) {
+				x = av[i]
+			}
+			if i < len(bv) {
+				y = bv[i]
+			}
+			changes = append(changes, diffJSON(path+"["+strconv.Itoa(i)+"]", x, y)...)
+		}
+		return changes
+	}
+
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+	return []FieldChange{{Path: path, A: a, B: b}}
+}
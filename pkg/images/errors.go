@@ -0,0 +1,100 @@
+package images
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/anotherjesse/r8im/pkg/auth"
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+var (
+	// ErrNotFound is returned when an image, manifest or blob does not
+	// exist in the registry.
+	ErrNotFound = errors.New("not found")
+	// ErrNoWeights is returned when an image has no weights layer.
+	ErrNoWeights = r8Layers.ErrNoWeights
+	// ErrHistoryMismatch is returned when the history in an image config
+	// does not line up with its layers.
+	ErrHistoryMismatch = errors.New("history does not match layers")
+	// ErrPushDenied is returned when the registry refuses a push.
+	ErrPushDenied = errors.New("push denied")
+	// ErrBaseMismatch is returned when an image does not share the layers
+	// of the base it is said to be built on.
+	ErrBaseMismatch = errors.New("image is not based on base")
+	// ErrWeightsUnchanged is returned when a delta update finds the
+	// weights directory matches the image.
+	ErrWeightsUnchanged = errors.New("weights are unchanged")
+	// ErrManifestMismatch is returned when a weights manifest given for a
+	// delta update lists files that aren't in the image.
+	ErrManifestMismatch = errors.New("weights manifest is not of image")
+)
+
+// registryError keeps the message and the underlying transport error of err
+// while also matching sentinel with errors.Is.
+type registryError struct {
+	sentinel error
+	err      error
+}
+
+func (e *registryError) Error() string        { return e.err.Error() }
+func (e *registryError) Unwrap() error        { return e.err }
+func (e *registryError) Is(target error) bool { return target == e.sentinel }
+
+// pullError classifies an error from reading an image or its config.
+func pullError(err error) error {
+	switch {
+	case isNotFound(err):
+		return &registryError{sentinel: ErrNotFound, err: err}
+	case isDenied(err):
+		return &registryError{sentinel: auth.ErrUnauthorized, err: err}
+	}
+	return err
+}
+
+// pushError classifies an error from writing an image.
+func pushError(err error) error {
+	switch {
+	case isDenied(err):
+		return &registryError{sentinel: ErrPushDenied, err: err}
+	case isNotFound(err):
+		return &registryError{sentinel: ErrNotFound, err: err}
+	}
+	return err
+}
+
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	for _, d := range terr.Errors {
+		switch d.Code {
+		case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode, transport.BlobUnknownErrorCode:
+			return true
+		}
+	}
+	return false
+}
+
+func isDenied(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden {
+		return true
+	}
+	for _, d := range terr.Errors {
+		switch d.Code {
+		case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+// weightsImage labels its config with the weights manifest of layer.
+//
+// Streamed layers only know their contents once they have been uploaded, so
+// the label is added lazily: until the layer has been consumed, config and
+// manifest accessors return stream.ErrNotComputed, which remote.Write
+// handles by uploading the layers before the config.
+type weightsImage struct {
+	v1.Image
+	layer v1.Layer
+	files func() ([]r8Layers.File, error)
+
+	mu      sync.Mutex
+	labeled v1.Image
+}
+
+var _ v1.Image = &weightsImage{}
+
+func withWeightsManifest(img v1.Image, layer v1.Layer, files func() ([]r8Layers.File, error)) v1.Image {
+	return &weightsImage{Image: img, layer: layer, files: files}
+}
+
+func (i *weightsImage) compute() (v1.Image, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.labeled != nil {
+		return i.labeled, nil
+	}
+
+	digest, err := i.layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := i.files()
+	if err != nil {
+		return nil, fmt.Errorf("hashing weights: %w", err)
+	}
+
+	for idx := range files {
+		files[idx].Layer = digest.String()
+	}
+	i.labeled, err = labelWeights(i.Image, files)
+	if err != nil {
+		return nil, err
+	}
+	return i.labeled, nil
+}
+
+// maxManifestLabel is the size of the largest weights manifest stored as a
+// label. Bigger ones would bloat the config, which every client fetches, so
+// they are left out and the manifest is read from the layers instead.
+const maxManifestLabel = 256 << 10
+
+// labelWeights stores files as the weights manifest of img, or removes the
+// label if there are no files or the manifest is too big for it, so that a
+// label left from the image below isn't taken for this one's.
+func labelWeights(img v1.Image, files []r8Layers.File) (v1.Image, error) {
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg := cf.DeepCopy()
+
+	b, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(files) == 0 || len(b) > maxManifestLabel:
+		delete(cfg.Config.Labels, r8Layers.ManifestLabel)
+	case cfg.Config.Labels == nil:
+		cfg.Config.Labels = map[string]string{r8Layers.ManifestLabel: string(b)}
+	default:
+		cfg.Config.Labels[r8Layers.ManifestLabel] = string(b)
+	}
+
+	return mutate.ConfigFile(img, cfg)
+}
+
+func (i *weightsImage) Size() (int64, error) {
+	img, err := i.compute()
+	if err != nil {
+		return 0, err
+	}
+	return img.Size()
+}
+
+func (i *weightsImage) ConfigName() (v1.Hash, error) {
+	img, err := i.compute()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return img.ConfigName()
+}
+
+func (i *weightsImage) ConfigFile() (*v1.ConfigFile, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.ConfigFile()
+}
+
+func (i *weightsImage) RawConfigFile() ([]byte, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.RawConfigFile()
+}
+
+func (i *weightsImage) Digest() (v1.Hash, error) {
+	img, err := i.compute()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return img.Digest()
+}
+
+func (i *weightsImage) Manifest() (*v1.Manifest, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.Manifest()
+}
+
+func (i *weightsImage) RawManifest() ([]byte, error) {
+	img, err := i.compute()
+	if err != nil {
+		return nil, err
+	}
+	return img.RawManifest()
+}
@@ -2,12 +2,9 @@ package images
 
 import (
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/crane"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
@@ -19,20 +16,27 @@ type Layer struct {
 	Raw       v1.Layer
 }
 
-func Layers(imageName string, auth authn.Authenticator) ([]Layer, error) {
+// Layers lists the layers of imageName. Reading a layer's Raw contents goes
+// through the cache set with WithCache, and downloads are reported to the
+// WithProgress reporter.
+func Layers(imageName string, opts ...Option) ([]Layer, error) {
+	o := makeOptions(opts...)
+	logger := o.logger
+
 	results := make([]Layer, 0)
 
 	var base v1.Image
 	var err error
 
-	fmt.Fprintln(os.Stderr, "fetching metadata for", imageName)
+	logger.Info("fetching metadata", "image", imageName)
 
 	start := time.Now()
-	base, err = crane.Pull(imageName, crane.WithAuth(auth))
+	base, err = o.pull(imageName)
 	if err != nil {
 		return nil, fmt.Errorf("pulling %w", err)
 	}
-	fmt.Fprintln(os.Stderr, "pulling took", time.Since(start))
+	logger.Info("pulling took", "duration", time.Since(start))
+	base = o.cache.Image(o.progress.Image(base))
 
 	layers, err := base.Layers()
 	if err != nil {
@@ -84,3 +88,40 @@ func Layers(imageName string, auth authn.Authenticator) ([]Layer, error) {
 
 	return results, nil
 }
+
+// WeightsLayers returns the layers that may hold weights, in the order they
+// should be searched: layers added with a "# weights" command first, then
+// the cog "COPY . /src" layers.
+func WeightsLayers(layers []Layer) []Layer {
+	candidates := make([]Layer, 0)
+	for _, layer := range layers {
+		if strings.HasSuffix(layer.Command, " # weights") {
+			candidates = append(candidates, layer)
+		}
+	}
+	for _, layer := range layers {
+		if strings.HasPrefix(layer.Command, "COPY . /src") {
+			candidates = append(candidates, layer)
+		}
+	}
+	return candidates
+}
+
+// weightsGroups returns WeightsLayers grouped the way they are searched:
+// the layers added by affix together, as the weights may be split over
+// several of them, then each cog layer on its own.
+func weightsGroups(layers []Layer) [][]Layer {
+	var affixed []Layer
+	var groups [][]Layer
+	for _, layer := range WeightsLayers(layers) {
+		if strings.HasSuffix(layer.Command, " # weights") {
+			affixed = append(affixed, layer)
+		} else {
+			groups = append(groups, []Layer{layer})
+		}
+	}
+	if len(affixed) > 0 {
+		groups = append([][]Layer{affixed}, groups...)
+	}
+	return groups
+}
@@ -0,0 +1,315 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/logs"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/anotherjesse/r8im/pkg/cache"
+	"github.com/anotherjesse/r8im/pkg/logging"
+	"github.com/anotherjesse/r8im/pkg/progress"
+	r8Transport "github.com/anotherjesse/r8im/pkg/transport"
+)
+
+// Option configures the functions in this package.
+type Option func(*options)
+
+type options struct {
+	ctx      context.Context
+	auth     authn.Authenticator
+	authFor  map[string]authn.Authenticator
+	keychain authn.Keychain
+	logger   *logging.Logger
+	progress *progress.Reporter
+	platform *v1.Platform
+	cache    *cache.Cache
+
+	transport   http.RoundTripper
+	backoff     *remote.Backoff
+	retryable   func(error) bool
+	insecure    bool
+	insecureFor map[string]bool
+}
+
+func makeOptions(opts ...Option) *options {
+	o := &options{
+		ctx:         context.Background(),
+		authFor:     map[string]authn.Authenticator{},
+		keychain:    authn.DefaultKeychain,
+		insecureFor: map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithContext sets the context for registry requests and long-running work.
+// Cancelling it aborts the operation.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithAuth sets the authenticator used for every registry that has no
+// authenticator of its own from WithAuthFor.
+func WithAuth(auth authn.Authenticator) Option {
+	return func(o *options) {
+		o.auth = auth
+	}
+}
+
+// WithAuthFor sets the authenticator used for references on registry, such
+// as "r8.im" or "index.docker.io".
+func WithAuthFor(registry string, auth authn.Authenticator) Option {
+	return func(o *options) {
+		o.authFor[registry] = auth
+	}
+}
+
+// WithKeychain sets the keychain consulted for registries without an
+// explicit authenticator. By default this is authn.DefaultKeychain, which
+// reads the docker config.
+func WithKeychain(keychain authn.Keychain) Option {
+	return func(o *options) {
+		o.keychain = keychain
+	}
+}
+
+// WithLogger sets where progress messages are logged. By default nothing is
+// logged.
+func WithLogger(logger *logging.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithProgress reports layer downloads and uploads to p.
+func WithProgress(p *progress.Reporter) Option {
+	return func(o *options) {
+		o.progress = p
+	}
+}
+
+// WithPlatform selects the image to use when a reference points at an
+// index.
+func WithPlatform(platform *v1.Platform) Option {
+	return func(o *options) {
+		o.platform = platform
+	}
+}
+
+// WithCache serves layer contents from c, filling it as layers are read.
+func WithCache(c *cache.Cache) Option {
+	return func(o *options) {
+		o.cache = c
+	}
+}
+
+// WithTransport sends registry requests through rt, for example one from
+// pkg/transport.New. go-containerregistry adds no retries of its own to
+// rt, so it should retry failed requests itself; by default the transport
+// of pkg/transport.New with its DefaultOptions is used.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = rt
+	}
+}
+
+// WithRetryBackoff sets how go-containerregistry retries whole blob
+// uploads and manifest writes that fail with a temporary error, such as
+// streamed uploads the transport can't send again.
+func WithRetryBackoff(backoff remote.Backoff) Option {
+	return func(o *options) {
+		o.backoff = &backoff
+	}
+}
+
+// WithRetryPredicate sets which errors go-containerregistry retries with
+// the backoff of WithRetryBackoff.
+func WithRetryPredicate(retryable func(error) bool) Option {
+	return func(o *options) {
+		o.retryable = retryable
+	}
+}
+
+// WithInsecure allows every registry to be reached over plain HTTP. TLS
+// certificate checks are up to the transport; see WithTransport.
+func WithInsecure() Option {
+	return func(o *options) {
+		o.insecure = true
+	}
+}
+
+// WithInsecureRegistry allows registry to be reached over plain HTTP. A
+// registry given without a port applies to every port of the host.
+func WithInsecureRegistry(registry string) Option {
+	return func(o *options) {
+		o.insecureFor[registry] = true
+	}
+}
+
+// authenticator returns the authenticator for ref, or nil to fall back to
+// the keychain.
+func (o *options) authenticator(ref string) authn.Authenticator {
+	if auth, ok := o.authFor[RegistryOf(ref)]; ok {
+		return auth
+	}
+	return o.auth
+}
+
+// RegistryOf returns the registry host of ref, or "" if it doesn't parse.
+func RegistryOf(ref string) string {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return ""
+	}
+	return r.Context().RegistryStr()
+}
+
+// nameOptions returns the options for parsing ref.
+func (o *options) nameOptions(ref string) []name.Option {
+	if insecure, _ := r8Transport.Lookup(o.insecureFor, RegistryOf(ref)); o.insecure || insecure {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+// crane returns the crane options for talking to the repository of ref
+// with scopes, pull access to it if none are given.
+//
+// The transport is authenticated here and handed to go-containerregistry
+// as a transport.Wrapper, which it sends requests through as they are,
+// so the retries of the transport are the only ones.
+func (o *options) crane(ref string, scopes ...string) ([]crane.Option, error) {
+	r, err := name.ParseReference(ref, o.nameOptions(ref)...)
+	if err != nil {
+		return nil, err
+	}
+	auth := o.authenticator(ref)
+	if auth == nil {
+		if auth, err = o.keychain.Resolve(r.Context()); err != nil {
+			return nil, err
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = []string{r.Scope(transport.PullScope)}
+	}
+	rt := o.transport
+	if rt == nil {
+		if rt, err = r8Transport.New(r8Transport.DefaultOptions()); err != nil {
+			return nil, err
+		}
+	}
+	if logs.Enabled(logs.Debug) {
+		rt = transport.NewLogger(rt)
+	}
+	rt, err = transport.NewWithContext(o.ctx, r.Context().Registry, auth, rt, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []crane.Option{crane.WithContext(o.ctx), crane.WithAuth(auth), crane.WithTransport(rt)}
+	if o.platform != nil {
+		opts = append(opts, crane.WithPlatform(o.platform))
+	}
+	if len(o.nameOptions(ref)) > 0 {
+		opts = append(opts, crane.Insecure)
+	}
+	if o.backoff != nil {
+		backoff := *o.backoff
+		opts = append(opts, func(co *crane.Options) {
+			co.Remote = append(co.Remote, remote.WithRetryBackoff(backoff))
+		})
+	}
+	if o.retryable != nil {
+		retryable := o.retryable
+		opts = append(opts, func(co *crane.Options) {
+			co.Remote = append(co.Remote, remote.WithRetryPredicate(retryable))
+		})
+	}
+	return opts, nil
+}
+
+// pushScopes returns the scopes for pushing layers to dest: push access to
+// its repository, and pull access to the repositories of the same registry
+// that layers can be mounted from, as go-containerregistry would ask for.
+func pushScopes(dest name.Reference, layers []v1.Layer) []string {
+	scopes := []string{dest.Scope(transport.PushScope)}
+	seen := map[string]bool{}
+	for _, l := range layers {
+		ml, ok := l.(*remote.MountableLayer)
+		if !ok {
+			continue
+		}
+		repo := ml.Reference.Context()
+		if repo.String() == dest.Context().String() || repo.RegistryStr() != dest.Context().RegistryStr() {
+			continue
+		}
+		if scope := ml.Reference.Scope(transport.PullScope); !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// pull fetches the manifest and config of ref. Layers are fetched lazily as
+// they are read.
+func (o *options) pull(ref string) (v1.Image, error) {
+	opts, err := o.crane(ref)
+	if err != nil {
+		return nil, pullError(err)
+	}
+	img, err := crane.Pull(ref, opts...)
+	if err != nil {
+		return nil, pullError(err)
+	}
+	return img, nil
+}
+
+// readLayers returns the layers of img wrapped to report their download
+// and to go through the cache, for reading their contents. Images that are
+// pushed should keep img's own layers, which go-containerregistry can mount
+// from the source repository instead of uploading them.
+func (o *options) readLayers(img v1.Image) ([]v1.Layer, error) {
+	layers, err := o.cache.Image(o.progress.Image(img)).Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers %w", err)
+	}
+	return layers, nil
+}
+
+// config fetches the config of ref, without pulling its layers.
+func (o *options) config(ref string) (*v1.ConfigFile, error) {
+	opts, err := o.crane(ref)
+	if err != nil {
+		return nil, fmt.Errorf("fetching config %w", pullError(err))
+	}
+	raw, err := crane.Config(ref, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching config %w", pullError(err))
+	}
+	cfg, err := v1.ParseConfigFile(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("parsing config %w", err)
+	}
+	return cfg, nil
+}
+
+// withProgress adds a remote.WithProgress option to opts.
+func withProgress(opts []crane.Option, updates chan<- v1.Update) []crane.Option {
+	return append(opts, func(co *crane.Options) {
+		co.Remote = append(co.Remote, remote.WithProgress(updates))
+	})
+}
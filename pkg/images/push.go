@@ -0,0 +1,96 @@
+package images
+
+import (
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+)
+
+// push pushes img to dest, reporting overall upload progress, and returns
+// which blobs had to be uploaded.
+func (o *options) push(img v1.Image, dest string) (*Transfer, error) {
+	po, rec, err := o.recordTransfer(dest)
+	if err != nil {
+		return nil, err
+	}
+	if err := po.write(img, dest); err != nil {
+		return nil, err
+	}
+
+	// streamed layers only know their size once uploaded
+	sizes := map[string]int64{}
+	if err := imageBlobSizes(img, sizes); err != nil {
+		return nil, err
+	}
+	t := rec.transfer(sizes)
+	o.logger.Debug("pushed blobs", "image", dest, "mounted", len(t.Mounted), "uploaded", len(t.Uploaded), "existing", len(t.Existing), "bytesSaved", t.BytesSaved)
+	return &t, nil
+}
+
+// pushIndex pushes idx and all its images to dest.
+func (o *options) pushIndex(idx v1.ImageIndex, dest string) (*Transfer, error) {
+	po, rec, err := o.recordTransfer(dest)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := name.ParseReference(dest, po.nameOptions(dest)...)
+	if err != nil {
+		return nil, err
+	}
+	// like go-containerregistry, ask for no scopes to mount from
+	opts, err := po.crane(dest, ref.Scope(transport.PushScope))
+	if err != nil {
+		return nil, pushError(err)
+	}
+	if err := remote.WriteIndex(ref, idx, crane.GetOptions(opts...).Remote...); err != nil {
+		return nil, pushError(err)
+	}
+
+	sizes := map[string]int64{}
+	if err := indexBlobSizes(idx, sizes); err != nil {
+		return nil, err
+	}
+	t := rec.transfer(sizes)
+	o.logger.Debug("pushed blobs", "image", dest, "mounted", len(t.Mounted), "uploaded", len(t.Uploaded), "existing", len(t.Existing), "bytesSaved", t.BytesSaved)
+	return &t, nil
+}
+
+func (o *options) write(img v1.Image, dest string) error {
+	ref, err := name.ParseReference(dest, o.nameOptions(dest)...)
+	if err != nil {
+		return err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	opts, err := o.crane(dest, pushScopes(ref, layers)...)
+	if err != nil {
+		return pushError(err)
+	}
+
+	// go-containerregistry can't count the size of streamed layers up front,
+	// so those are reported as they are read instead.
+	if streaming := hasStreamLayer(layers); streaming || o.progress == nil {
+		return pushError(crane.Push(img, dest, opts...))
+	}
+
+	t := o.progress.Start("push "+dest, 0)
+	updates, finish := t.Updates()
+
+	err = crane.Push(img, dest, withProgress(opts, updates)...)
+	finish(err)
+	return pushError(err)
+}
+
+func hasStreamLayer(layers []v1.Layer) bool {
+	for _, l := range layers {
+		if _, ok := l.(*stream.Layer); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package images
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// RearrangeResult describes an image pushed by DeleteLayers, MoveLayer or
+// ReorderLayers.
+type RearrangeResult struct {
+	// Ref is the pushed image, as dest@digest.
+	Ref    string
+	Digest v1.Hash
+	// Order lists the index in the source image of each layer of the
+	// pushed one.
+	Order []int
+	Transfer
+}
+
+// DeleteLayers pushes src to dest without the given layers. Layers are
+// given by index, counting from 0 or, if negative, back from the last
+// layer, or by a unique prefix of their digest or diff_id.
+//
+// Empty history entries, such as ENV, stay where they were; the config is
+// otherwise unchanged.
+func DeleteLayers(src string, dest string, layers []string, opts ...Option) (*RearrangeResult, error) {
+	return rearrange(src, dest, opts, func(all []DiffLayer) ([]int, error) {
+		drop := map[int]bool{}
+		for _, ref := range layers {
+			i, err := findLayer(all, ref)
+			if err != nil {
+				return nil, err
+			}
+			drop[i] = true
+		}
+		if len(drop) == 0 {
+			return nil, fmt.Errorf("no layers to delete")
+		}
+		var order []int
+		for i := range all {
+			if !drop[i] {
+				order = append(order, i)
+			}
+		}
+		return order, nil
+	})
+}
+
+// MoveLayer pushes src to dest with layer moved to index to, shifting the
+// layers in between. layer is given as for DeleteLayers; to may be
+// negative to count back from the last layer.
+func MoveLayer(src string, dest string, layer string, to int, opts ...Option) (*RearrangeResult, error) {
+	return rearrange(src, dest, opts, func(all []DiffLayer) ([]int, error) {
+		from, err := findLayer(all, layer)
+		if err != nil {
+			return nil, err
+		}
+		if to < 0 {
+			to += len(all)
+		}
+		if to < 0 || to >= len(all) {
+			return nil, fmt.Errorf("can't move layer to %d, the image has %d layers", to, len(all))
+		}
+
+		order := make([]int, 0, len(all))
+		for i := range all {
+			if i != from {
+				order = append(order, i)
+			}
+		}
+		order = append(order[:to], append([]int{from}, order[to:]...)...)
+		return order, nil
+	})
+}
+
+// ReorderLayers pushes src to dest with its layers in the given order,
+// which must name every layer once, as for DeleteLayers.
+func ReorderLayers(src string, dest string, order []string, opts ...Option) (*RearrangeResult, error) {
+	return rearrange(src, dest, opts, func(all []DiffLayer) ([]int, error) {
+		if len(order) != len(all) {
+			return nil, fmt.Errorf("the order names %d layers, the image has %d", len(order), len(all))
+		}
+		seen := map[int]bool{}
+		out := make([]int, len(order))
+		for k, ref := range order {
+			i, err := findLayer(all, ref)
+			if err != nil {
+				return nil, err
+			}
+			if seen[i] {
+				return nil, fmt.Errorf("layer %d is named twice", i)
+			}
+			seen[i] = true
+			out[k] = i
+		}
+		return out, nil
+	})
+}
+
+// rearrange pushes src to dest with the layers picked by order, which
+// returns the index in src of each layer of the new image.
+func rearrange(src string, dest string, opts []Option, order func([]DiffLayer) ([]int, error)) (*RearrangeResult, error) {
+	o := makeOptions(opts...)
+	logger := o.logger
+
+	logger.Info("fetching metadata", "image", src)
+	start := time.Now()
+	img, err := o.pull(src)
+	if err != nil {
+		return nil, fmt.Errorf("pulling %w", err)
+	}
+	logger.Info("pulling took", "duration", time.Since(start))
+
+	all, err := diffLayerList(img)
+	if err != nil {
+		return nil, err
+	}
+	picked, err := order(all)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("rearranging layers", "from", len(all), "to", len(picked))
+
+	rearranged, err := withLayers(img, picked)
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	transfer, err := o.push(rearranged, dest)
+	if err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", dest, err)
+	}
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
+
+	d, err := rearranged.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &RearrangeResult{
+		Ref:      fmt.Sprintf("%s@%s", dest, d),
+		Digest:   d,
+		Order:    picked,
+		Transfer: *transfer,
+	}, nil
+}
+
+// withLayers rebuilds img with the layers at the indexes in order. Each
+// layer keeps its own history entry; the slots of the layers in the
+// history are filled in the new order, so that empty entries stay where
+// they were. The diff_ids follow from the layers.
+func withLayers(img v1.Image, order []int) (v1.Image, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting config %w", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers %w", err)
+	}
+	adds, err := historyLayers(cfg.History, layers)
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[int]bool, len(order))
+	for _, i := range order {
+		keep[i] = true
+	}
+	var layerAdds []mutate.Addendum
+	var out []mutate.Addendum
+	var slots []int
+	for _, add := range adds {
+		if add.Layer == nil {
+			out = append(out, add)
+			continue
+		}
+		i := len(layerAdds)
+		layerAdds = append(layerAdds, add)
+		if keep[i] {
+			slots = append(slots, len(out))
+			out = append(out, mutate.Addendum{})
+		}
+	}
+	for k, pos := range slots {
+		out[pos] = layerAdds[order[k]]
+	}
+
+	return rebuild(img, cfg, out)
+}
+
+// rebuild builds an image from adds on an empty base, of the same media
+// type as img, with the config of cfg apart from the history and rootfs.
+func rebuild(img v1.Image, cfg *v1.ConfigFile, adds []mutate.Addendum) (v1.Image, error) {
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting media type %w", err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest %w", err)
+	}
+	base := mutate.ConfigMediaType(mutate.MediaType(empty.Image, mt), m.Config.MediaType)
+
+	out, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, fmt.Errorf("appending layers %w", err)
+	}
+	return mutateConfig(out, func(oc *v1.ConfigFile) error {
+		history, rootfs := oc.History, oc.RootFS
+		*oc = *cfg.DeepCopy()
+		oc.RootFS = rootfs
+		// mutate.Append adds an entry per layer, which images built
+		// without history didn't have
+		if len(cfg.History) > 0 {
+			oc.History = history
+		}
+		return nil
+	})
+}
+
+// findLayer returns the index of the layer ref names: an index, negative
+// to count from the end, or a unique prefix of a digest or diff_id.
+func findLayer(layers []DiffLayer, ref string) (int, error) {
+	if i, err := strconv.Atoi(ref); err == nil {
+		if i < 0 {
+			i += len(layers)
+		}
+		if i < 0 || i >= len(layers) {
+			return 0, fmt.Errorf("no layer %s, the image has %d layers", ref, len(layers))
+		}
+		return i, nil
+	}
+
+	prefix := strings.TrimPrefix(ref, "sha256:")
+	found := -1
+	for i, l := range layers {
+		if strings.HasPrefix(l.Digest.Hex, prefix) || strings.HasPrefix(l.DiffID.Hex, prefix) {
+			if found >= 0 && found != i {
+				return 0, fmt.Errorf("%q matches more than one layer", ref)
+			}
+			found = i
+		}
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("no layer matches %q", ref)
+	}
+	return found, nil
+}
@@ -0,0 +1,299 @@
+package images
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// RebaseResult describes an image pushed by Rebase.
+type RebaseResult struct {
+	// Ref is the pushed image, as dest@digest.
+	Ref    string
+	Digest v1.Hash
+	// Replaced is how many layers of the image were found to come from
+	// the old base and were swapped for the new base's.
+	Replaced int
+	// Kept is how many layers above the old base were kept.
+	Kept int
+	Transfer
+}
+
+// Rebase moves the layers of imageRef above oldBaseRef onto newBaseRef
+// and pushes the result to dest.
+//
+// The base layers are the longest prefix of layers, by diff_id, that the
+// image shares with oldBaseRef. They are replaced by all of newBaseRef's
+// layers and history, while the upper layers keep their history. Config
+// settings the image inherited unchanged from the old base, such as PATH
+// or CUDA_VERSION, take the new base's values; those the image changed
+// are kept.
+//
+// If the image shares only some of oldBaseRef's layers, oldBaseRef is
+// probably not its base, and Rebase returns an error wrapping
+// ErrBaseMismatch unless force is set.
+func Rebase(imageRef string, oldBaseRef string, newBaseRef string, dest string, force bool, opts ...Option) (*RebaseResult, error) {
+	o := makeOptions(opts...)
+	logger := o.logger
+
+	refs := []string{imageRef, oldBaseRef, newBaseRef}
+	imgs := make([]v1.Image, len(refs))
+	cfgs := make([]*v1.ConfigFile, len(refs))
+	start := time.Now()
+	for i, ref := range refs {
+		logger.Info("fetching metadata", "image", ref)
+		img, err := o.pull(ref)
+		if err != nil {
+			return nil, fmt.Errorf("pulling %w", err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("getting config %w", err)
+		}
+		imgs[i], cfgs[i] = img, cfg
+	}
+	logger.Info("pulling took", "duration", time.Since(start))
+	img, newBase := imgs[0], imgs[2]
+	cfg, oldCfg, newCfg := cfgs[0], cfgs[1], cfgs[2]
+
+	shared := sharedPrefix(cfg.RootFS.DiffIDs, oldCfg.RootFS.DiffIDs)
+	if shared == 0 {
+		return nil, fmt.Errorf("%w: %s shares no layers with %s", ErrBaseMismatch, imageRef, oldBaseRef)
+	}
+	if shared < len(oldCfg.RootFS.DiffIDs) {
+		if !force {
+			return nil, fmt.Errorf("%w: %s only shares %d of the %d layers of %s", ErrBaseMismatch, imageRef, shared, len(oldCfg.RootFS.DiffIDs), oldBaseRef)
+		}
+		logger.Warn("image only shares some layers with the old base", "shared", shared, "oldBaseLayers", len(oldCfg.RootFS.DiffIDs))
+	}
+	if cfg.OS != newCfg.OS || cfg.Architecture != newCfg.Architecture {
+		logger.Warn("new base is for a different platform", "image", cfg.OS+"/"+cfg.Architecture, "newBase", newCfg.OS+"/"+newCfg.Architecture)
+	}
+	logger.Info("found base layers", "shared", shared, "kept", len(cfg.RootFS.DiffIDs)-shared)
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers %w", err)
+	}
+	adds, err := historyLayers(cfg.History, layers)
+	if err != nil {
+		return nil, err
+	}
+	upper := adds[baseHistoryLen(adds, shared, cfg.History, oldCfg.History):]
+
+	rebased, err := mutate.Append(newBase, upper...)
+	if err != nil {
+		return nil, fmt.Errorf("appending layers %w", err)
+	}
+	rebased, err = mutateConfig(rebased, func(rc *v1.ConfigFile) error {
+		rc.Created = cfg.Created
+		rc.Author = cfg.Author
+		rc.Config = rebaseConfig(cfg.Config, oldCfg.Config, newCfg.Config)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	transfer, err := o.push(rebased, dest)
+	if err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", dest, err)
+	}
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
+
+	d, err := rebased.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &RebaseResult{
+		Ref:      fmt.Sprintf("%s@%s", dest, d),
+		Digest:   d,
+		Replaced: shared,
+		Kept:     len(layers) - shared,
+		Transfer: *transfer,
+	}, nil
+}
+
+// sharedPrefix returns how many leading diff_ids a and b have in common.
+func sharedPrefix(a, b []v1.Hash) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// historyLayers pairs each history entry with its layer, leaving Layer nil
+// for empty layers, the way images are put together with mutate.Append.
+// Images without history get an empty entry per layer.
+func historyLayers(history []v1.History, layers []v1.Layer) ([]mutate.Addendum, error) {
+	if len(history) == 0 {
+		adds := make([]mutate.Addendum, len(layers))
+		for i, l := range layers {
+			adds[i].Layer = l
+		}
+		return adds, nil
+	}
+
+	nonEmpty := 0
+	for _, h := range history {
+		if !h.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty != len(layers) {
+		return nil, fmt.Errorf("%w: number of non-empty history entries (%d) is different from number of layers (%d)", ErrHistoryMismatch, nonEmpty, len(layers))
+	}
+
+	adds := make([]mutate.Addendum, len(history))
+	i := 0
+	for h := range history {
+		adds[h].History = history[h]
+		if !history[h].EmptyLayer {
+			adds[h].Layer = layers[i]
+			i++
+		}
+	}
+	return adds, nil
+}
+
+func countLayers(adds []mutate.Addendum) int {
+	n := 0
+	for _, a := range adds {
+		if a.Layer != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// baseHistoryLen returns how many of adds belong to the base: up to the
+// layer-th layer, and the empty entries after it if the image's history
+// starts with the whole of the base's, as it does for a FROM.
+func baseHistoryLen(adds []mutate.Addendum, layers int, history, baseHistory []v1.History) int {
+	n, seen := 0, 0
+	for ; n < len(adds) && seen < layers; n++ {
+		if adds[n].Layer != nil {
+			seen++
+		}
+	}
+	if len(baseHistory) < n || len(baseHistory) > len(history) {
+		return n
+	}
+	for i, h := range baseHistory {
+		if h.CreatedBy != history[i].CreatedBy || h.EmptyLayer != history[i].EmptyLayer {
+			return n
+		}
+	}
+	if countLayers(adds[:len(baseHistory)]) != layers {
+		return n
+	}
+	return len(baseHistory)
+}
+
+// rebaseConfig returns cfg with the settings it inherited unchanged from
+// oldBase replaced by newBase's.
+func rebaseConfig(cfg, oldBase, newBase v1.Config) v1.Config {
+	out := *cfg.DeepCopy()
+
+	out.Env = rebaseEnv(cfg.Env, oldBase.Env, newBase.Env)
+	out.Labels = rebaseLabels(cfg.Labels, oldBase.Labels, newBase.Labels)
+
+	inherited := func(a, b interface{}) bool { return reflect.DeepEqual(a, b) }
+	if inherited(cfg.Entrypoint, oldBase.Entrypoint) {
+		out.Entrypoint = newBase.Entrypoint
+	}
+	if inherited(cfg.Cmd, oldBase.Cmd) {
+		out.Cmd = newBase.Cmd
+	}
+	if inherited(cfg.Shell, oldBase.Shell) {
+		out.Shell = newBase.Shell
+	}
+	if cfg.WorkingDir == oldBase.WorkingDir {
+		out.WorkingDir = newBase.WorkingDir
+	}
+	if cfg.User == oldBase.User {
+		out.User = newBase.User
+	}
+	if cfg.StopSignal == oldBase.StopSignal {
+		out.StopSignal = newBase.StopSignal
+	}
+	if inherited(cfg.ExposedPorts, oldBase.ExposedPorts) {
+		out.ExposedPorts = newBase.ExposedPorts
+	}
+	if inherited(cfg.Volumes, oldBase.Volumes) {
+		out.Volumes = newBase.Volumes
+	}
+	if inherited(cfg.Healthcheck, oldBase.Healthcheck) {
+		out.Healthcheck = newBase.Healthcheck
+	}
+	return out
+}
+
+// rebaseEnv keeps the variables env set or changed itself, and takes the
+// rest from newBase.
+func rebaseEnv(env, oldBase, newBase []string) []string {
+	old := envMap(oldBase)
+	cur := envMap(env)
+	inNew := envMap(newBase)
+
+	// the image's own variables replace the new base's in place, and the
+	// rest follow in the order the image had them
+	set := map[string]string{}
+	var unset, added []string
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		if ov, ok := old[k]; ok && ov == v {
+			continue
+		}
+		if _, ok := inNew[k]; ok {
+			set[k] = v
+		} else {
+			added = append(added, k+"="+v)
+		}
+	}
+	for k := range old {
+		if _, ok := cur[k]; !ok {
+			// the image removed a variable of the old base
+			unset = append(unset, k)
+		}
+	}
+	return append(editEnv(newBase, set, unset), added...)
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
+
+// rebaseLabels works like rebaseEnv for labels.
+func rebaseLabels(labels, oldBase, newBase map[string]string) map[string]string {
+	out := make(map[string]string, len(newBase)+len(labels))
+	for k, v := range newBase {
+		if _, ok := oldBase[k]; ok {
+			if _, kept := labels[k]; !kept {
+				// the image removed a label of the old base
+				continue
+			}
+		}
+		out[k] = v
+	}
+	for k, v := range labels {
+		if ov, ok := oldBase[k]; !ok || ov != v {
+			out[k] = v
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
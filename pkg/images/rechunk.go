@@ -0,0 +1,519 @@
+package images
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+// Chunking says how Rechunk groups files into layers. The zero value uses
+// the defaults below.
+type Chunking struct {
+	// MaxLayers is the most layers to make, 100 if 0. The smallest groups
+	// are merged into one layer to stay under it.
+	MaxLayers int
+	// MinSize is the size under which a group of files is merged into the
+	// group of its parent directory, 1MB if 0.
+	MinSize int64
+	// KeepMtimes keeps the modification times of files. By default they
+	// are cleared, so that the same files installed at different times
+	// make the same layer.
+	KeepMtimes bool
+	// Compression is how the layers are compressed, gzip by default.
+	Compression Compression
+}
+
+// Chunk is a layer made by Rechunk.
+type Chunk struct {
+	// Key is the directory or package the files of the chunk come from.
+	Key    string
+	Files  int
+	Size   int64
+	Digest v1.Hash
+}
+
+// RechunkResult describes an image pushed by Rechunk.
+type RechunkResult struct {
+	// Ref is the pushed image, as dest@digest.
+	Ref    string
+	Digest v1.Hash
+	Chunks []Chunk
+	Transfer
+}
+
+// Rechunk pushes src to dest with its filesystem redistributed into layers
+// of related files: one per Python or Node package, and otherwise per
+// directory, with small groups merged into their parent directory's. The
+// tars are written the same way every time, so images built from similar
+// environments share the layers for the packages they have in common.
+//
+// The original history is kept as empty entries, followed by an entry per
+// chunk. Weights under /src/weights go in the last chunks, with the same
+// history affix writes, and the weights manifest label is updated to match.
+func Rechunk(src string, dest string, chunking Chunking, opts ...Option) (*RechunkResult, error) {
+	if err := chunking.Compression.validate(); err != nil {
+		return nil, err
+	}
+	if chunking.MaxLayers == 0 {
+		chunking.MaxLayers = 100
+	}
+	if chunking.MinSize == 0 {
+		chunking.MinSize = 1 << 20
+	}
+
+	o := makeOptions(opts...)
+	logger := o.logger
+
+	logger.Info("fetching metadata", "image", src)
+	start := time.Now()
+	base, err := o.pull(src)
+	if err != nil {
+		return nil, fmt.Errorf("pulling %w", err)
+	}
+	logger.Info("pulling took", "duration", time.Since(start))
+
+	cfg, err := base.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting config %w", err)
+	}
+	mt, err := base.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting media type %w", err)
+	}
+
+	f, err := os.CreateTemp("", "r8im-rechunk-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	logger.Info("reading filesystem", "image", src)
+	start = time.Now()
+	entries, dirs, err := spoolFilesystem(o.ctx, o.cache.Image(o.progress.Image(base)), f)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("reading filesystem took", "entries", len(entries), "duration", time.Since(start))
+
+	groups := chunkGroups(entries, chunking)
+	logger.Info("rechunking", "chunks", len(groups))
+
+	start = time.Now()
+	var adds []mutate.Addendum
+	for _, h := range cfg.History {
+		h.EmptyLayer = true
+		adds = append(adds, mutate.Addendum{History: h})
+	}
+	chunks := make([]Chunk, len(groups))
+	layerOf := map[string]v1.Hash{}
+	for i, g := range groups {
+		g := g
+		layer, err := compressedLayer(func() (io.ReadCloser, error) {
+			pr, pw := io.Pipe()
+			go func() {
+				pw.CloseWithError(writeChunk(pw, f, g, dirs, chunking.KeepMtimes))
+			}()
+			return pr, nil
+		}, chunking.Compression, mt)
+		if err != nil {
+			return nil, fmt.Errorf("writing chunk %s: %w", g.key, err)
+		}
+		d, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		chunks[i] = Chunk{Key: g.key, Files: len(g.entries), Size: g.size, Digest: d}
+		logger.Debug("wrote chunk", "key", g.key, "files", len(g.entries), "size", g.size, "digest", d)
+		for _, e := range g.entries {
+			layerOf[e.hdr.Name] = d
+		}
+
+		h := v1.History{
+			Created:   cfg.Created,
+			CreatedBy: "rechunk " + g.key,
+			Author:    "r8im",
+			Comment:   "rechunk",
+		}
+		if g.weights {
+			h.CreatedBy = "cp . /src/weights # weights"
+			h.Comment = "weights"
+		}
+		adds = append(adds, mutate.Addendum{Layer: layer, History: h})
+	}
+	logger.Info("rechunking took", "duration", time.Since(start))
+
+	cfg = cfg.DeepCopy()
+	if err := relabelWeights(cfg, layerOf); err != nil {
+		return nil, err
+	}
+	rechunked, err := rebuild(base, cfg, adds)
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	transfer, err := o.push(rechunked, dest)
+	if err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", dest, err)
+	}
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
+
+	d, err := rechunked.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &RechunkResult{
+		Ref:      fmt.Sprintf("%s@%s", dest, d),
+		Digest:   d,
+		Chunks:   chunks,
+		Transfer: *transfer,
+	}, nil
+}
+
+// spoolEntry is an entry of the filesystem spooled by spoolFilesystem.
+type spoolEntry struct {
+	hdr *tar.Header
+	// offset is where the contents start in the spooled tar.
+	offset int64
+	key    string
+}
+
+// spoolFilesystem writes the merged filesystem of img to f and returns its
+// entries, keyed by chunkKey, and the headers of its directories by path.
+// Hard links get the key of their target, so both end up in the same layer.
+func spoolFilesystem(ctx context.Context, img v1.Image, f *os.File) ([]*spoolEntry, map[string]*tar.Header, error) {
+	rc := mutate.Extract(img)
+	_, err := io.Copy(f, r8Layers.WithContext(ctx, rc))
+	rc.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading filesystem: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	var entries []*spoolEntry
+	byName := map[string]*spoolEntry{}
+	dirs := map[string]*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading filesystem: %w", err)
+		}
+		p := cleanPath(hdr.Name)
+		if p == "." {
+			continue
+		}
+		hdr.Name = p
+		e := &spoolEntry{hdr: hdr, offset: cr.n, key: chunkKey(p, hdr.Typeflag == tar.TypeDir)}
+		entries = append(entries, e)
+		byName[p] = e
+		if hdr.Typeflag == tar.TypeDir {
+			dirs[p] = hdr
+		}
+	}
+
+	// Hard links go in the chunk of the file they link to, wherever it is in
+	// the stream, so keys are only assigned once every entry is known.
+	for _, e := range entries {
+		target := e
+		for i := 0; i < len(entries) && target.hdr.Typeflag == tar.TypeLink; i++ {
+			t, ok := byName[cleanPath(target.hdr.Linkname)]
+			if !ok {
+				break
+			}
+			target = t
+		}
+		if target.hdr.Typeflag != tar.TypeLink {
+			e.key = target.key
+		}
+	}
+	return entries, dirs, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// chunkKey returns the group of the file at p: the package it belongs to in
+// site-packages, dist-packages or node_modules, the top directory of the
+// weights it is in, or else its directory, up to three levels deep.
+func chunkKey(p string, dir bool) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts[:len(parts)-1] {
+		switch part {
+		case "site-packages", "dist-packages":
+			return path.Join(path.Join(parts[:i+1]...), pythonPackage(parts[i+1], dir || i+2 < len(parts)))
+		case "node_modules":
+			n := i + 2
+			if strings.HasPrefix(parts[i+1], "@") && n < len(parts) {
+				n++
+			}
+			return path.Join(parts[:n]...)
+		}
+	}
+	if len(parts) > 2 && parts[0] == "src" && parts[1] == "weights" {
+		return path.Join(parts[:3]...)
+	}
+
+	if !dir {
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+	if len(parts) == 0 {
+		return "."
+	}
+	return path.Join(parts...)
+}
+
+// pythonPackage returns the name of the package an entry of site-packages
+// belongs to, so that numpy/ and numpy-1.26.0.dist-info/ go together.
+func pythonPackage(name string, dir bool) string {
+	switch {
+	case strings.HasSuffix(name, ".dist-info"), strings.HasSuffix(name, ".egg-info"), strings.HasSuffix(name, ".data"):
+		name, _, _ = strings.Cut(name, "-")
+	case !dir:
+		name, _, _ = strings.Cut(name, ".")
+	}
+	return strings.ToLower(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// chunkGroup is the entries that go into one layer.
+type chunkGroup struct {
+	key     string
+	entries []*spoolEntry
+	size    int64
+	weights bool
+}
+
+// chunkGroups groups entries by key, merging groups smaller than
+// c.MinSize into their parent directory's, and then the smallest groups
+// into the root's until there are at most c.MaxLayers. Groups are sorted
+// by key, with the weights last.
+func chunkGroups(entries []*spoolEntry, c Chunking) []*chunkGroup {
+	byKey := map[string]*chunkGroup{}
+	group := func(key string) *chunkGroup {
+		g, ok := byKey[key]
+		if !ok {
+			g = &chunkGroup{key: key}
+			byKey[key] = g
+		}
+		return g
+	}
+	merge := func(from, to string) {
+		g := group(to)
+		g.entries = append(g.entries, byKey[from].entries...)
+		g.size += byKey[from].size
+		delete(byKey, from)
+	}
+	for _, e := range entries {
+		g := group(e.key)
+		g.entries = append(g.entries, e)
+		g.size += e.hdr.Size
+	}
+
+	// deepest keys first, so small groups can add up in their parent;
+	// weights only go up to src/weights
+	depth := func(k string) int {
+		if k == "." {
+			return 0
+		}
+		return strings.Count(k, "/") + 1
+	}
+	deepest := 0
+	for k := range byKey {
+		deepest = max(deepest, depth(k))
+	}
+	for d := deepest; d > 0; d-- {
+		for _, k := range sortedGroupKeys(byKey) {
+			if depth(k) != d || byKey[k].size >= c.MinSize || k == "src/weights" {
+				continue
+			}
+			if isWeightsKey(k) {
+				merge(k, "src/weights")
+			} else {
+				merge(k, path.Dir(k))
+			}
+		}
+	}
+
+	if len(byKey) > c.MaxLayers {
+		keys := sortedGroupKeys(byKey)
+		sort.SliceStable(keys, func(i, j int) bool { return byKey[keys[i]].size < byKey[keys[j]].size })
+		for _, k := range keys {
+			if len(byKey) <= c.MaxLayers {
+				break
+			}
+			if k != "." && !isWeightsKey(k) {
+				merge(k, ".")
+			}
+		}
+	}
+
+	groups := make([]*chunkGroup, 0, len(byKey))
+	for _, k := range sortedGroupKeys(byKey) {
+		g := byKey[k]
+		g.weights = isWeightsKey(k)
+		sort.Slice(g.entries, func(i, j int) bool { return g.entries[i].hdr.Name < g.entries[j].hdr.Name })
+		groups = append(groups, g)
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return !groups[i].weights && groups[j].weights })
+	return groups
+}
+
+func sortedGroupKeys(m map[string]*chunkGroup) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isWeightsKey(key string) bool {
+	return key == "src/weights" || strings.HasPrefix(key, "src/weights/")
+}
+
+// writeChunk writes the entries of g, read from the spooled filesystem in
+// f, to w as a tar. Every directory above an entry is written too, with
+// its header from dirs, so each layer can be applied on its own without
+// changing the directories of the others. Owner names and, unless
+// keepMtimes, modification times are cleared.
+func writeChunk(w io.Writer, f *os.File, g *chunkGroup, dirs map[string]*tar.Header, keepMtimes bool) error {
+	tw := tar.NewWriter(w)
+	written := map[string]bool{}
+	write := func(hdr *tar.Header, r io.Reader) error {
+		out := &tar.Header{
+			Typeflag: hdr.Typeflag,
+			Name:     hdr.Name,
+			Linkname: hdr.Linkname,
+			Size:     hdr.Size,
+			Mode:     hdr.Mode,
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			Devmajor: hdr.Devmajor,
+			Devminor: hdr.Devminor,
+			Format:   tar.FormatPAX,
+		}
+		if keepMtimes {
+			out.ModTime = hdr.ModTime.Truncate(time.Second)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			out.Name += "/"
+		}
+		// keep extended attributes, such as file capabilities
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, "SCHILY.xattr.") {
+				if out.PAXRecords == nil {
+					out.PAXRecords = map[string]string{}
+				}
+				out.PAXRecords[k] = v
+			}
+		}
+		if err := tw.WriteHeader(out); err != nil {
+			return err
+		}
+		if r != nil {
+			_, err := io.Copy(tw, r)
+			return err
+		}
+		return nil
+	}
+
+	var writeDir func(p string) error
+	writeDir = func(p string) error {
+		if p == "." || written[p] {
+			return nil
+		}
+		if err := writeDir(path.Dir(p)); err != nil {
+			return err
+		}
+		written[p] = true
+		hdr, ok := dirs[p]
+		if !ok {
+			// not in the filesystem's tar, only implied by its contents
+			hdr = &tar.Header{Typeflag: tar.TypeDir, Name: p, Mode: 0o755}
+		}
+		return write(hdr, nil)
+	}
+
+	for _, e := range g.entries {
+		if err := writeDir(path.Dir(e.hdr.Name)); err != nil {
+			return err
+		}
+		if e.hdr.Typeflag == tar.TypeDir {
+			if err := writeDir(e.hdr.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		var r io.Reader
+		if e.hdr.Typeflag == tar.TypeReg {
+			r = io.NewSectionReader(f, e.offset, e.hdr.Size)
+		}
+		if err := write(e.hdr, r); err != nil {
+			return fmt.Errorf("writing %s: %w", e.hdr.Name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// relabelWeights points the files in the weights manifest label of cfg, if
+// it has one, at the layers they were moved to.
+func relabelWeights(cfg *v1.ConfigFile, layerOf map[string]v1.Hash) error {
+	raw, ok := cfg.Config.Labels[r8Layers.ManifestLabel]
+	if !ok {
+		return nil
+	}
+	var files []r8Layers.File
+	if err := json.Unmarshal([]byte(raw), &files); err != nil {
+		return fmt.Errorf("parsing %s label: %w", r8Layers.ManifestLabel, err)
+	}
+	for i, f := range files {
+		if d, ok := layerOf[path.Join("src/weights", f.Path)]; ok {
+			files[i].Layer = d.String()
+		}
+	}
+	b, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	cfg.Config.Labels[r8Layers.ManifestLabel] = string(b)
+	return nil
+}
+
+func (c Compression) validate() error {
+	switch c {
+	case CompressionGzip, CompressionZstd, CompressionNone, "":
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, expected gzip, zstd or none", c)
+}
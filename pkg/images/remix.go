@@ -2,127 +2,205 @@ package images
 
 import (
 	"fmt"
-	"os"
+	"strings"
 	"time"
 
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/crane"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+	"github.com/anotherjesse/r8im/pkg/logging"
 )
 
-func Remix(auth authn.Authenticator) error {
-	// results := make([]Layer, 0)
+// RemixResult describes an image pushed by Remix.
+type RemixResult struct {
+	// Ref is the pushed image, as dest@digest.
+	Ref    string
+	Digest v1.Hash
+	// WeightsLayers are the digests of the layers taken from the weights
+	// image.
+	WeightsLayers []v1.Hash
+	// Delta lists the files changed by RemixDelta.
+	Delta *WeightsDelta
+	Transfer
+}
+
+// Remix appends the weights layers of weightsRef to baseRef and pushes the
+// result to dest. Layers of images on the same registry as dest, such as
+// the weights layer, are mounted rather than streamed through the client
+// and uploaded again; if the registry refuses a mount the layer is
+// uploaded.
+func Remix(baseRef string, weightsRef string, dest string, opts ...Option) (*RemixResult, error) {
+	return remix(baseRef, weightsRef, dest, "", nil, opts)
+}
 
-	var base v1.Image
-	var err error
+// RemixDelta works like Remix, then appends a delta layer with the files
+// of dir that differ from the weights of weightsRef, as AffixDelta does.
+// If manifest is nil the weights are listed with WeightsManifest; otherwise
+// every file it lists must be in a layer of weightsRef.
+func RemixDelta(baseRef string, weightsRef string, dest string, dir string, manifest *r8Layers.Manifest, opts ...Option) (*RemixResult, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no weights directory to compare")
+	}
+	return remix(baseRef, weightsRef, dest, dir, manifest, opts)
+}
 
-	weights_image := "r8.im/anotherjesse/faster@sha256:2922cfb4febba1a72cacc9d407a726efe5a87ce32e2be5b4e5817209db87b7d1"
+func remix(baseRef string, weightsRef string, dest string, dir string, manifest *r8Layers.Manifest, opts []Option) (*RemixResult, error) {
+	o := makeOptions(opts...)
+	logger := o.logger
 
-	fmt.Fprintln(os.Stderr, "fetching metadata for", weights_image)
+	logger.Info("fetching metadata", "image", weightsRef)
 	start := time.Now()
-	weights, err := crane.Pull(weights_image, crane.WithAuth(auth))
+	weightsImage, err := o.pull(weightsRef)
 	if err != nil {
-		return fmt.Errorf("pulling %w", err)
+		return nil, fmt.Errorf("pulling %w", err)
 	}
-	fmt.Fprintln(os.Stderr, "pulling took", time.Since(start))
+	logger.Info("pulling took", "duration", time.Since(start))
 
-	base_image := "r8.im/anotherjesse/find@sha256:ef93356c06503ad651b7efe1ed705c58633826a0acfd664f50094eaac9829b79"
-	fmt.Fprintln(os.Stderr, "fetching metadata for", base_image)
+	logger.Info("fetching metadata", "image", baseRef)
 	start = time.Now()
-	base, err = crane.Pull(base_image, crane.WithAuth(auth))
+	baseImage, err := o.pull(baseRef)
 	if err != nil {
-		return fmt.Errorf("pulling %w", err)
+		return nil, fmt.Errorf("pulling %w", err)
 	}
-	fmt.Fprintln(os.Stderr, "pulling took", time.Since(start))
+	logger.Info("pulling took", "duration", time.Since(start))
 
-	weights_layer_id := "sha256:23a377230e377792bdfb5321e5d470140c405366daa9bd5aa7d1c6ff3bc6f772"
+	checkRemix(logger, baseRef, weightsRef, baseImage, weightsImage)
 
-	fmt.Fprintln(os.Stderr, "finding layer", weights_layer_id)
-	layers, err := weights.Layers()
+	logger.Info("finding weights layer")
+
+	start = time.Now()
+	weightsLayers, err := findWeightsLayers(weightsImage)
 	if err != nil {
-		return fmt.Errorf("getting layers %w", err)
+		return nil, fmt.Errorf("finding weights layer in %s: %w", weightsRef, err)
 	}
-	var weights_layer v1.Layer
-	for _, layer := range layers {
-		digest, err := layer.Digest()
-		if err != nil {
-			return fmt.Errorf("getting digest %w", err)
-		}
-		if digest.String() == weights_layer_id {
-			weights_layer = layer
-			break
+	weightsDigests := make([]v1.Hash, len(weightsLayers))
+	for i, l := range weightsLayers {
+		if weightsDigests[i], err = l.Digest(); err != nil {
+			return nil, fmt.Errorf("getting digest %w", err)
 		}
 	}
+	logger.Info("finding weights layer took", "layers", weightsDigests, "duration", time.Since(start))
 
 	start = time.Now()
-	mutant, err := mutate.AppendLayers(base, weights_layer)
+	mutant, err := appendLayers(baseImage, weightsLayers...)
 	if err != nil {
-		return fmt.Errorf("appending layers %w", err)
+		return nil, fmt.Errorf("appending layers %w", err)
+	}
+	logger.Info("appending layers took", "duration", time.Since(start))
+
+	var delta *WeightsDelta
+	if dir != "" {
+		if manifest == nil {
+			if manifest, err = WeightsManifest(weightsRef, opts...); err != nil {
+				return nil, err
+			}
+		} else if err := checkManifest(manifest, weightsRef, weightsImage); err != nil {
+			return nil, err
+		}
+		start = time.Now()
+		if mutant, delta, err = appendDelta(mutant, dir, manifest, logger); err != nil {
+			return nil, err
+		}
+		weightsDigests = append(weightsDigests, delta.Layer)
+		logger.Info("appending delta took", "duration", time.Since(start))
 	}
-	fmt.Fprintln(os.Stderr, "appending layers took", time.Since(start))
-	fmt.Fprintln(os.Stderr, "mutant image:", mutant)
 
 	// --- pushing image
 
-	dest := "r8.im/anotherjesse/faster"
-
 	start = time.Now()
 
-	err = crane.Push(mutant, dest, crane.WithAuth(auth))
+	transfer, err := o.push(mutant, dest)
+	if err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", dest, err)
+	}
+
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
+
+	d, err := mutant.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &RemixResult{
+		Ref:           fmt.Sprintf("%s@%s", dest, d),
+		Digest:        d,
+		WeightsLayers: weightsDigests,
+		Delta:         delta,
+		Transfer:      *transfer,
+	}, nil
+}
+
+// findWeightsLayers returns the layers affix added to image: the first
+// run of layers with a weights history entry, as affix may split the
+// weights over several.
+func findWeightsLayers(image v1.Image) ([]v1.Layer, error) {
+	cfg, err := image.ConfigFile()
 	if err != nil {
-		return fmt.Errorf("pushing %s: %w", dest, err)
-	}
-
-	fmt.Fprintln(os.Stderr, "pushing took", time.Since(start))
-
-	// layers, err := base.Layers()
-	// if err != nil {
-	// 	return nil, fmt.Errorf("getting layers %w", err)
-	// }
-
-	// for _, layer := range layers {
-	// 	digest, err := layer.Digest()
-	// 	if err != nil {
-	// 		return nil, fmt.Errorf("getting digest %w", err)
-	// 	}
-
-	// 	size, err := layer.Size()
-	// 	if err != nil {
-	// 		return nil, fmt.Errorf("getting size %w", err)
-	// 	}
-	// 	mediatype, err := layer.MediaType()
-	// 	if err != nil {
-	// 		return nil, fmt.Errorf("getting mediatype %w", err)
-	// 	}
-
-	// 	results = append(results, Layer{
-	// 		Digest:    digest.String(),
-	// 		Size:      size,
-	// 		MediaType: string(mediatype),
-	// 	})
-	// }
-
-	// // Grab the commands from the history
-	// cfg, nil := base.ConfigFile()
-	// if err != nil {
-	// 	return results, fmt.Errorf("getting config %w", err)
-	// }
-	// idx := 0
-	// for _, h := range cfg.History {
-	// 	if h.EmptyLayer {
-	// 		continue
-	// 	}
-
-	// 	s := strings.TrimPrefix(h.CreatedBy, "/bin/sh -c ")
-	// 	s = strings.TrimPrefix(s, "#(nop) ")
-	// 	if len(s) > 40 {
-	// 		s = s[:40]
-	// 	}
-	// 	results[idx].Command = s
-	// 	idx++
-	// }
-
-	// return results, nil
-	return nil
+		return nil, fmt.Errorf("getting config %w", err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers %w", err)
+	}
+	var found []v1.Layer
+	idx := 0
+	for _, h := range cfg.History {
+		if h.EmptyLayer {
+			continue
+		}
+		if h.Comment == "weights" && idx < len(layers) {
+			found = append(found, layers[idx])
+		} else if len(found) > 0 {
+			break
+		}
+		idx++
+	}
+	if len(found) == 0 {
+		return nil, ErrNoWeights
+	}
+	return found, nil
+}
+
+// checkRemix warns if the weights image looks like it was built for
+// something else than the base image: another platform, another base
+// entirely, or one that diverges from it within its base image layers, such
+// as one built on another CUDA or Python base.
+func checkRemix(logger *logging.Logger, baseRef, weightsRef string, base, weights v1.Image) {
+	a, err := ancestry([]string{baseRef, weightsRef}, []v1.Image{base, weights})
+	if err != nil {
+		logger.Warn("can't compare base and weights images", "error", err)
+		return
+	}
+	if !a.SamePlatform {
+		logger.Warn("base and weights images are for different platforms", "base", a.Images[0].Platform, "weights", a.Images[1].Platform)
+	}
+	if len(a.Shared) == 0 {
+		logger.Warn("base and weights images share no base layers", "base", baseRef, "weights", weightsRef)
+		return
+	}
+	baseLayers, err := diffLayerList(base)
+	if err != nil {
+		logger.Warn("can't compare base and weights images", "error", err)
+		return
+	}
+	if n := baseImageLayers(baseLayers); len(a.Shared) < n && a.Images[1].Diverges != nil {
+		logger.Warn("weights image diverges from base within its base image layers",
+			"layer", len(a.Shared), "baseImageLayers", n,
+			"base", a.Images[0].Diverges.Digest, "weights", a.Images[1].Diverges.Digest)
+		return
+	}
+	logger.Debug("base and weights images share layers", "shared", len(a.Shared))
+}
+
+// baseImageLayers returns how many of layers come from the image a cog
+// image was built on, that is the layers before its first "COPY . /src" or
+// weights layer, or all of them if it has neither.
+func baseImageLayers(layers []DiffLayer) int {
+	for i, l := range layers {
+		s := strings.TrimPrefix(l.CreatedBy, "/bin/sh -c ")
+		s = strings.TrimPrefix(s, "#(nop) ")
+		if strings.HasPrefix(s, "COPY . /src") || strings.HasSuffix(s, " # weights") {
+			return i
+		}
+	}
+	return len(layers)
 }
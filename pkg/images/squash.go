@@ -0,0 +1,360 @@
+package images
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/compression"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+// Compression is how a layer written by r8im is compressed.
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+	CompressionNone Compression = "none"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// SquashResult describes an image pushed by SquashLayers.
+type SquashResult struct {
+	// Ref is the pushed image, as dest@digest.
+	Ref    string
+	Digest v1.Hash
+	// Layer is the layer the range was squashed into.
+	Layer v1.Descriptor
+	// Squashed is how many layers were squashed into Layer.
+	Squashed int
+	Transfer
+}
+
+// SquashLayers pushes src to dest with the layers from from to to,
+// inclusive, merged into a single layer compressed with c. from and to are
+// given as for DeleteLayers.
+//
+// Files deleted or replaced within the range are left out, and whiteouts
+// that still apply to the layers below the range are kept. The history
+// entries of the range, including empty ones, become one entry. Layers
+// outside the range are pushed unchanged.
+func SquashLayers(src string, dest string, from string, to string, c Compression, opts ...Option) (*SquashResult, error) {
+	o := makeOptions(opts...)
+	logger := o.logger
+
+	logger.Info("fetching metadata", "image", src)
+	start := time.Now()
+	base, err := o.pull(src)
+	if err != nil {
+		return nil, fmt.Errorf("pulling %w", err)
+	}
+	logger.Info("pulling took", "duration", time.Since(start))
+
+	all, err := diffLayerList(base)
+	if err != nil {
+		return nil, err
+	}
+	first, err := findLayer(all, from)
+	if err != nil {
+		return nil, err
+	}
+	last, err := findLayer(all, to)
+	if err != nil {
+		return nil, err
+	}
+	if first > last {
+		return nil, fmt.Errorf("can't squash from layer %d down to layer %d", first, last)
+	}
+
+	cfg, err := base.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting config %w", err)
+	}
+	layers, err := base.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers %w", err)
+	}
+	adds, err := historyLayers(cfg.History, layers)
+	if err != nil {
+		return nil, err
+	}
+	read, err := o.readLayers(base)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp("", "r8im-squash-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	logger.Info("squashing layers", "from", first, "to", last)
+	start = time.Now()
+	err = squash(o.ctx, read[first:last+1], f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("squashing layers: %w", err)
+	}
+	mt, err := base.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting media type %w", err)
+	}
+	squashed, err := compressedLayer(func() (io.ReadCloser, error) { return os.Open(f.Name()) }, c, mt)
+	if err != nil {
+		return nil, fmt.Errorf("creating squashed layer: %w", err)
+	}
+	desc, err := layerDescriptor(squashed)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("squashing took", "layer", desc.Digest, "size", desc.Size, "duration", time.Since(start))
+
+	// the entries of the range run from the first layer's to the last
+	// layer's, taking in the empty ones between them
+	var begin, end, seen int
+	for i, add := range adds {
+		if add.Layer == nil {
+			continue
+		}
+		if seen == first {
+			begin = i
+		}
+		if seen == last {
+			end = i + 1
+		}
+		seen++
+	}
+	out := append([]mutate.Addendum{}, adds[:begin]...)
+	out = append(out, mutate.Addendum{Layer: squashed, History: squashHistory(adds[begin:end])})
+	out = append(out, adds[end:]...)
+
+	squashedImg, err := rebuild(base, cfg, out)
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	transfer, err := o.push(squashedImg, dest)
+	if err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", dest, err)
+	}
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
+
+	d, err := squashedImg.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &SquashResult{
+		Ref:      fmt.Sprintf("%s@%s", dest, d),
+		Digest:   d,
+		Layer:    *desc,
+		Squashed: last - first + 1,
+		Transfer: *transfer,
+	}, nil
+}
+
+// compressedLayer makes a layer of the tar opener returns, compressed with
+// c. gzip layers get the layer media type that goes with the manifest's.
+func compressedLayer(opener tarball.Opener, c Compression, mt types.MediaType) (v1.Layer, error) {
+	switch c {
+	case CompressionGzip, "":
+		layerType := types.DockerLayer
+		if mt == types.OCIManifestSchema1 {
+			layerType = types.OCILayer
+		}
+		return tarball.LayerFromOpener(opener, tarball.WithMediaType(layerType))
+	case CompressionZstd:
+		return tarball.LayerFromOpener(opener,
+			tarball.WithCompression(compression.ZStd),
+			tarball.WithMediaType(types.OCILayerZStd),
+			tarball.WithCompressionLevel(11),
+		)
+	case CompressionNone:
+		l, err := tarball.LayerFromOpener(opener)
+		if err != nil {
+			return nil, err
+		}
+		return newUncompressedLayer(l)
+	}
+	return nil, fmt.Errorf("unknown compression %q, expected gzip, zstd or none", c)
+}
+
+// squashHistory folds the history entries of a squashed range into one.
+func squashHistory(adds []mutate.Addendum) v1.History {
+	var createdBy []string
+	for _, add := range adds {
+		if add.History.CreatedBy != "" {
+			createdBy = append(createdBy, add.History.CreatedBy)
+		}
+	}
+	return v1.History{
+		Created:   adds[len(adds)-1].History.Created,
+		CreatedBy: strings.Join(createdBy, " && "),
+		Author:    "r8im",
+		Comment:   fmt.Sprintf("squashed %d history entries", len(adds)),
+	}
+}
+
+// squash writes to w the tar of layers merged into one, the top layer
+// winning. Layers are read from the top down: a path is written the first
+// time it is seen, unless a layer above deleted it or made its directory
+// opaque. Whiteouts are kept for the layers below the range, unless a
+// layer above, or the whiteout's own, put the path back. They are written
+// once the rest of their layer has been read, so that is known.
+func squash(ctx context.Context, layers []v1.Layer, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	// paths written so far, and whether they are directories
+	written := map[string]bool{}
+	// directories given an opaque whiteout so far
+	madeOpaque := map[string]bool{}
+	// paths deleted and directories made opaque by the layers read so far
+	deleted := map[string]bool{}
+	opaque := map[string]bool{}
+
+	// hidden reports whether a layer above hides p from the one being read
+	hidden := func(p string) bool {
+		if deleted[p] {
+			return true
+		}
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if deleted[dir] || opaque[dir] {
+				return true
+			}
+			// a file above replaced a directory of p
+			if isDir, ok := written[dir]; ok && !isDir {
+				return true
+			}
+		}
+		return opaque["."]
+	}
+
+	whiteout := func(p string) error {
+		return tw.WriteHeader(&tar.Header{
+			Name:     p,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Format:   tar.FormatPAX,
+		})
+	}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		var deletes, opaques []string
+		err := func() error {
+			rc, err := layers[i].Uncompressed()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			tr := tar.NewReader(r8Layers.WithContext(ctx, rc))
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+
+				p := cleanPath(hdr.Name)
+				dir, base := path.Split(p)
+				dir = cleanPath(dir)
+				switch {
+				case base == opaqueWhiteout:
+					opaques = append(opaques, dir)
+					continue
+				case strings.HasPrefix(base, whiteoutPrefix):
+					deletes = append(deletes, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+					continue
+				}
+				if _, ok := written[p]; ok || hidden(p) {
+					continue
+				}
+				written[p] = hdr.Typeflag == tar.TypeDir
+
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+				if _, err := io.Copy(tw, tr); err != nil {
+					return fmt.Errorf("copying %s: %w", hdr.Name, err)
+				}
+			}
+		}()
+		if err != nil {
+			return fmt.Errorf("reading layer %d: %w", i, err)
+		}
+
+		for _, dir := range opaques {
+			if hidden(dir) || madeOpaque[dir] {
+				continue
+			}
+			if isDir, ok := written[dir]; ok && !isDir {
+				continue
+			}
+			madeOpaque[dir] = true
+			if err := whiteout(path.Join(dir, opaqueWhiteout)); err != nil {
+				return err
+			}
+		}
+		for _, p := range deletes {
+			if hidden(p) || madeOpaque[p] {
+				continue
+			}
+			isDir, ok := written[p]
+			switch {
+			case ok && !isDir:
+				// a file above replaced it
+				continue
+			case ok:
+				// a directory above was made after the delete, so it
+				// must not be merged with the one below
+				madeOpaque[p] = true
+				err = whiteout(path.Join(p, opaqueWhiteout))
+			default:
+				dir, base := path.Split(p)
+				err = whiteout(dir + whiteoutPrefix + base)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		// deletes only apply to the layers below, not to the rest of the
+		// layer they are in
+		for _, p := range deletes {
+			deleted[p] = true
+		}
+		for _, p := range opaques {
+			opaque[p] = true
+		}
+	}
+	return tw.Close()
+}
+
+// cleanPath returns the path of a tar entry without leading ./ or /, or "."
+// for the root.
+func cleanPath(name string) string {
+	if p := strings.TrimPrefix(path.Clean("/"+name), "/"); p != "" {
+		return p
+	}
+	return "."
+}
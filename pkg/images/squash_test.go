@@ -0,0 +1,207 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// testLayer makes a layer of entries, given as "path" for a file holding
+// its own path, "path/" for a directory or "path -> target" for a symlink.
+func testLayer(t *testing.T, entries ...string) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e, Typeflag: tar.TypeReg, Mode: 0o644}
+		var body string
+		switch {
+		case strings.HasSuffix(e, "/"):
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0o755
+		case strings.Contains(e, " -> "):
+			parts := strings.SplitN(e, " -> ", 2)
+			hdr.Name, hdr.Linkname = parts[0], parts[1]
+			hdr.Typeflag = tar.TypeSymlink
+		default:
+			body = e
+			hdr.Size = int64(len(body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// squashed returns the entries of the layers squashed, sorted, in the form
+// testLayer takes them, with the contents of files that don't hold their
+// own path after "=".
+func squashed(t *testing.T, layers ...v1.Layer) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := squash(context.Background(), layers, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := cleanPath(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			name += "/"
+		case tar.TypeSymlink:
+			name += " -> " + hdr.Linkname
+		default:
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) > 0 && string(b) != hdr.Name {
+				name += "=" + string(b)
+			}
+		}
+		entries = append(entries, name)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func TestSquash(t *testing.T) {
+	tests := []struct {
+		name string
+		// layers from the bottom up
+		layers [][]string
+		want   []string
+	}{
+		{
+			name: "upper file wins",
+			layers: [][]string{
+				{"etc/", "etc/a", "etc/b"},
+				{"etc/", "etc/b -> a"},
+			},
+			want: []string{"etc/", "etc/a", "etc/b -> a"},
+		},
+		{
+			name: "whiteout drops the file and is kept for the layers below",
+			layers: [][]string{
+				{"etc/", "etc/a", "etc/b"},
+				{"etc/.wh.a"},
+			},
+			want: []string{"etc/", "etc/.wh.a", "etc/b"},
+		},
+		{
+			name: "whiteout only applies to the layers below its own",
+			layers: [][]string{
+				{"etc/", "etc/a"},
+				{"etc/.wh.a", "etc/a"},
+			},
+			want: []string{"etc/", "etc/a"},
+		},
+		{
+			name: "file put back above a whiteout",
+			layers: [][]string{
+				{"etc/", "etc/a"},
+				{"etc/.wh.a"},
+				{"etc/a"},
+			},
+			want: []string{"etc/", "etc/a"},
+		},
+		{
+			name: "whiteout of a directory hides its contents",
+			layers: [][]string{
+				{"opt/", "opt/app/", "opt/app/bin", "opt/keep"},
+				{"opt/.wh.app"},
+			},
+			want: []string{"opt/", "opt/.wh.app", "opt/keep"},
+		},
+		{
+			name: "directory recreated above its whiteout becomes opaque",
+			layers: [][]string{
+				{"opt/", "opt/app/", "opt/app/old"},
+				{"opt/.wh.app"},
+				{"opt/app/", "opt/app/new"},
+			},
+			want: []string{"opt/", "opt/app/", "opt/app/.wh..wh..opq", "opt/app/new"},
+		},
+		{
+			name: "opaque directory hides the contents below it",
+			layers: [][]string{
+				{"var/", "var/cache/", "var/cache/old", "var/log"},
+				{"var/cache/", "var/cache/.wh..wh..opq", "var/cache/new"},
+			},
+			want: []string{"var/", "var/cache/", "var/cache/.wh..wh..opq", "var/cache/new", "var/log"},
+		},
+		{
+			name: "opaque marker under a deleted directory is dropped",
+			layers: [][]string{
+				{"var/", "var/cache/", "var/cache/.wh..wh..opq", "var/cache/new"},
+				{"var/.wh.cache"},
+			},
+			want: []string{"var/", "var/.wh.cache"},
+		},
+		{
+			name: "file replacing a directory hides its contents",
+			layers: [][]string{
+				{"data/", "data/x"},
+				{"data"},
+			},
+			want: []string{"data"},
+		},
+		{
+			name: "directory replacing a file",
+			layers: [][]string{
+				{"data"},
+				{"data/", "data/x"},
+			},
+			want: []string{"data/", "data/x"},
+		},
+		{
+			name: "whiteout of a path the range never had",
+			layers: [][]string{
+				{"etc/", "etc/a"},
+				{"etc/.wh.b"},
+			},
+			want: []string{"etc/", "etc/.wh.b", "etc/a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layers := make([]v1.Layer, len(tt.layers))
+			for i, entries := range tt.layers {
+				layers[i] = testLayer(t, entries...)
+			}
+			if got := squashed(t, layers...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package images
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	r8Transport "github.com/anotherjesse/r8im/pkg/transport"
+)
+
+// Transfer describes what happened to the blobs of a pushed image.
+//
+// Layers pulled from a repository on the destination registry are mounted
+// with a cross-repository mount, so the registry links the existing blob
+// instead of the client uploading it again. If the registry refuses the
+// mount the blob is uploaded.
+type Transfer struct {
+	// Mounted blobs were linked from another repository by the registry.
+	Mounted []v1.Hash
+	// Uploaded blobs were sent in full.
+	Uploaded []v1.Hash
+	// Existing blobs were already in the destination repository.
+	Existing []v1.Hash
+	// BytesSaved is the size of the mounted and existing blobs, which
+	// didn't have to be uploaded.
+	BytesSaved int64
+}
+
+// recordTransfer returns a copy of o whose requests to the repository of
+// dest are watched to see what happens to each blob.
+func (o *options) recordTransfer(dest string) (*options, *blobRecorder, error) {
+	ref, err := name.ParseReference(dest, o.nameOptions(dest)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inner := o.transport
+	if inner == nil {
+		if inner, err = r8Transport.New(r8Transport.DefaultOptions()); err != nil {
+			return nil, nil, err
+		}
+	}
+	rec := &blobRecorder{inner: inner, prefix: "/v2/" + ref.Context().RepositoryStr() + "/blobs/"}
+
+	po := *o
+	po.transport = rec
+	return &po, rec, nil
+}
+
+// imageBlobSizes returns the size of the config and layers of img, by
+// digest.
+func imageBlobSizes(img v1.Image, sizes map[string]int64) error {
+	m, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	sizes[m.Config.Digest.String()] = m.Config.Size
+	for _, l := range m.Layers {
+		sizes[l.Digest.String()] = l.Size
+	}
+	return nil
+}
+
+// indexBlobSizes returns the size of every blob of the images in idx, by
+// digest.
+func indexBlobSizes(idx v1.ImageIndex, sizes map[string]int64) error {
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, desc := range m.Manifests {
+		switch {
+		case desc.MediaType.IsImage():
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if err := imageBlobSizes(img, sizes); err != nil {
+				return err
+			}
+		case desc.MediaType.IsIndex():
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if err := indexBlobSizes(child, sizes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type blobAction int
+
+const (
+	blobExisting blobAction = iota
+	blobMounted
+	blobUploaded
+)
+
+// blobRecorder notes, from the registry's responses, which blobs pushed to
+// the repository at prefix already existed, were mounted or were uploaded.
+type blobRecorder struct {
+	inner  http.RoundTripper
+	prefix string
+
+	mu    sync.Mutex
+	blobs map[string]blobAction
+}
+
+func (b *blobRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := b.inner.RoundTrip(req)
+	if err != nil || !strings.HasPrefix(req.URL.Path, b.prefix) {
+		return resp, err
+	}
+
+	q := req.URL.Query()
+	switch {
+	case req.Method == http.MethodHead && resp.StatusCode == http.StatusOK:
+		b.record(strings.TrimPrefix(req.URL.Path, b.prefix), blobExisting)
+	case req.Method == http.MethodPost && q.Get("mount") != "" && resp.StatusCode == http.StatusCreated:
+		b.record(q.Get("mount"), blobMounted)
+	case req.Method == http.MethodPut && q.Get("digest") != "" && resp.StatusCode == http.StatusCreated:
+		b.record(q.Get("digest"), blobUploaded)
+	}
+	return resp, err
+}
+
+func (b *blobRecorder) record(digest string, action blobAction) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.blobs == nil {
+		b.blobs = map[string]blobAction{}
+	}
+	b.blobs[digest] = action
+}
+
+// transfer summarizes what was recorded, using sizes to count the bytes
+// saved.
+func (b *blobRecorder) transfer(sizes map[string]int64) Transfer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := Transfer{Mounted: []v1.Hash{}, Uploaded: []v1.Hash{}, Existing: []v1.Hash{}}
+	for digest, action := range b.blobs {
+		h, err := v1.NewHash(digest)
+		if err != nil {
+			continue
+		}
+		switch action {
+		case blobExisting:
+			t.Existing = append(t.Existing, h)
+			t.BytesSaved += sizes[digest]
+		case blobMounted:
+			t.Mounted = append(t.Mounted, h)
+			t.BytesSaved += sizes[digest]
+		case blobUploaded:
+			t.Uploaded = append(t.Uploaded, h)
+		}
+	}
+	for _, hashes := range [][]v1.Hash{t.Mounted, t.Uploaded, t.Existing} {
+		sort.Slice(hashes, func(i, j int) bool { return hashes[i].String() < hashes[j].String() })
+	}
+	return t
+}
@@ -0,0 +1,100 @@
+package images
+
+import (
+	"fmt"
+	"io"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+// WeightsManifest lists the weights files of imageName. If affix recorded a
+// manifest in the image config it is used as is; otherwise the weights layer
+// is streamed and hashed, without writing the files anywhere.
+func WeightsManifest(imageName string, opts ...Option) (*r8Layers.Manifest, error) {
+	o := makeOptions(opts...)
+
+	cfg, err := o.config(imageName)
+	if err != nil {
+		return nil, err
+	}
+	m, err := r8Layers.ManifestFromLabels(imageName, cfg.Config.Labels)
+	if err != nil || m != nil {
+		return m, err
+	}
+
+	o.logger.Info("no weights manifest in config, hashing weights layer", "image", imageName)
+
+	layers, err := Layers(imageName, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range weightsGroups(layers) {
+		files, err := r8Layers.HashTars(layerTars(o, group))
+		if err != nil {
+			return nil, fmt.Errorf("hashing weights: %w", err)
+		}
+		if len(files) > 0 {
+			return &r8Layers.Manifest{Image: imageName, Files: files}, nil
+		}
+	}
+
+	return nil, ErrNoWeights
+}
+
+// ExtractResult describes the weights written by ExtractWeights.
+type ExtractResult struct {
+	// Layer is the digest of the layer the weights were found in, the
+	// first of them if they are split over several.
+	Layer    string
+	Manifest *r8Layers.Manifest
+}
+
+// ExtractWeights writes the weights of imageName as a tar to dest, or to
+// stdout if dest is empty. Layers added by affix are searched first, then
+// cog's "COPY . /src" layers.
+func ExtractWeights(imageName string, dest string, opts ...Option) (*ExtractResult, error) {
+	o := makeOptions(opts...)
+
+	layers, err := Layers(imageName, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range weightsGroups(layers) {
+		files, err := r8Layers.ExtractTars(layerTars(o, group), dest, o.logger)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 {
+			return &ExtractResult{
+				Layer:    group[0].Digest,
+				Manifest: &r8Layers.Manifest{Image: imageName, Files: files},
+			}, nil
+		}
+	}
+
+	return nil, ErrNoWeights
+}
+
+// layerTars opens the uncompressed contents of layers as they are read.
+func layerTars(o *options, layers []Layer) []r8Layers.LayerTar {
+	tars := make([]r8Layers.LayerTar, len(layers))
+	for i, layer := range layers {
+		raw := layer.Raw
+		tars[i] = r8Layers.LayerTar{
+			Digest: layer.Digest,
+			Open: func() (io.ReadCloser, error) {
+				rc, err := raw.Uncompressed()
+				if err != nil {
+					return nil, err
+				}
+				return struct {
+					io.Reader
+					io.Closer
+				}{r8Layers.WithContext(o.ctx, rc), rc}, nil
+			},
+		}
+	}
+	return tars
+}
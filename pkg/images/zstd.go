@@ -1,19 +1,20 @@
 package images
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"time"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/compression"
-	"github.com/google/go-containerregistry/pkg/crane"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/anotherjesse/r8im/pkg/logging"
 )
 
 type uncompressedLayer struct {
@@ -85,58 +86,88 @@ func max(a, b int) int {
 	return b
 }
 
-func Zstd(imageName string, dest string, auth authn.Authenticator) (string, error) {
+// ZstdResult describes an image pushed by Zstd.
+type ZstdResult struct {
+	// Ref is the pushed image, as dest@digest.
+	Ref    string
+	Digest v1.Hash
+	Layers []RecompressedLayer
+	Transfer
+}
+
+// RecompressedLayer maps a layer of the source image to its replacement.
+type RecompressedLayer struct {
+	Index     int
+	From      v1.Descriptor
+	To        v1.Descriptor
+	CreatedBy string
+}
+
+// Zstd recompresses the layers of imageName with zstd where that saves at
+// least 10%, storing the rest uncompressed, and pushes the result to dest.
+func Zstd(imageName string, dest string, opts ...Option) (*ZstdResult, error) {
+	o := makeOptions(opts...)
+	logger := o.logger
+
 	var base v1.Image
 	var err error
 
-	fmt.Fprintln(os.Stderr, "fetching metadata for", imageName)
+	logger.Info("fetching metadata", "image", imageName)
 
 	start := time.Now()
-	base, err = crane.Pull(imageName, crane.WithAuth(auth))
+	base, err = o.pull(imageName)
 	if err != nil {
-		return "", fmt.Errorf("pulling %w", err)
+		return nil, fmt.Errorf("pulling %w", err)
 	}
-	fmt.Fprintln(os.Stderr, "pulling took", time.Since(start))
+	logger.Info("pulling took", "duration", time.Since(start))
 
-	img, err := zstd(base)
+	read, err := o.readLayers(base)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	img, recompressed, err := zstd(o.ctx, base, read, logger)
+	if err != nil {
+		return nil, err
 	}
 
 	start = time.Now()
 
-	err = crane.Push(img, dest, crane.WithAuth(auth))
+	transfer, err := o.push(img, dest)
 	if err != nil {
-		return "", fmt.Errorf("pushing %s: %w", dest, err)
+		return nil, fmt.Errorf("pushing %s: %w", dest, err)
 	}
 
-	fmt.Fprintln(os.Stderr, "pushing took", time.Since(start))
+	logger.Info("pushing took", "image", dest, "duration", time.Since(start))
 
 	d, err := img.Digest()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	image_id := fmt.Sprintf("%s@%s", dest, d)
-	return image_id, nil
+	return &ZstdResult{Ref: image_id, Digest: d, Layers: recompressed, Transfer: *transfer}, nil
 }
 
-func zstd(base v1.Image) (v1.Image, error) {
+// zstd recompresses the layers of base, reading them from read. Layers that
+// come out the same are kept as base's own, so they can still be mounted.
+func zstd(ctx context.Context, base v1.Image, read []v1.Layer, logger *logging.Logger) (v1.Image, []RecompressedLayer, error) {
 
 	// inspired by https://github.com/google/go-containerregistry/blob/v0.15.2/pkg/v1/mutate/mutate.go#L371
 	newImage := empty.Image
 
 	layers, err := base.Layers()
 	if err != nil {
-		return nil, fmt.Errorf("getting layers %w", err)
+		return nil, nil, fmt.Errorf("getting layers %w", err)
 	}
 
 	ocf, err := base.ConfigFile()
 	if err != nil {
-		return nil, fmt.Errorf("getting original config file %w", err)
+		return nil, nil, fmt.Errorf("getting original config file %w", err)
 	}
 
 	addendums := make([]mutate.Addendum, max(len(ocf.History), len(layers)))
 
+	recompressed := make([]RecompressedLayer, 0, len(layers))
+
 	startRecompressing := time.Now()
 
 	// we want nonEmptyHistory to be the v1.History entries that are not EmptyLayer
@@ -148,27 +179,48 @@ func zstd(base v1.Image) (v1.Image, error) {
 		}
 	}
 	if len(nonEmptyHistory) != len(layers) {
-		return nil, fmt.Errorf("number of non-empty history entries (%d) is different from number of layers (%d)", len(nonEmptyHistory), len(layers))
+		return nil, nil, fmt.Errorf("%w: number of non-empty history entries (%d) is different from number of layers (%d)", ErrHistoryMismatch, len(nonEmptyHistory), len(layers))
 	}
 
 	var historyIdx, addendumIdx int
 	for layerIdx := 0; layerIdx < len(layers); addendumIdx, layerIdx = addendumIdx+1, layerIdx+1 {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
 		startLayer := time.Now()
 		compressedSize, err := layers[layerIdx].Size()
 		if err != nil {
-			return nil, fmt.Errorf("getting compressed size: %w", err)
+			return nil, nil, fmt.Errorf("getting compressed size: %w", err)
+		}
+		logger.Info("recompressing layer", "layer", layerIdx, "size", compressedSize, "createdBy", nonEmptyHistory[layerIdx].CreatedBy)
+		newLayer, err := recompressLayer(read[layerIdx], logger.With("layer", layerIdx))
+		if err != nil {
+			return nil, nil, fmt.Errorf("setting recompressed layer: %w", err)
 		}
-		fmt.Fprintln(os.Stderr, "recompressing layer", layerIdx, compressedSize, "created by", nonEmptyHistory[layerIdx].CreatedBy, "with size")
-		newLayer, err := recompressLayer(layers[layerIdx])
+		from, err := layerDescriptor(layers[layerIdx])
 		if err != nil {
-			return nil, fmt.Errorf("setting recompressed layer: %w", err)
+			return nil, nil, err
 		}
+		to, err := layerDescriptor(newLayer)
+		if err != nil {
+			return nil, nil, err
+		}
+		if to.Digest == from.Digest {
+			newLayer = layers[layerIdx]
+		}
+		recompressed = append(recompressed, RecompressedLayer{
+			Index:     layerIdx,
+			From:      *from,
+			To:        *to,
+			CreatedBy: nonEmptyHistory[layerIdx].CreatedBy,
+		})
+
 		// truncate time to 3 decimal places
 		truncTime := time.Duration(int64(time.Since(startLayer).Seconds()*1000)) * time.Millisecond
-		fmt.Fprintln(os.Stderr, "recompressing layer", layerIdx, "took", truncTime)
+		logger.Info("recompressing layer took", "layer", layerIdx, "duration", truncTime)
 		// uncompressedSize, err := newLayer.Size()
 		if err != nil {
-			return nil, fmt.Errorf("getting recompressed size: %w", err)
+			return nil, nil, fmt.Errorf("getting recompressed size: %w", err)
 		}
 		// compressionRatio := int(float64(compressedSize)/float64(uncompressedSize)*100) / 100.0
 		// fmt.Fprintln(os.Stderr,
@@ -193,7 +245,7 @@ func zstd(base v1.Image) (v1.Image, error) {
 		}
 		addendums[addendumIdx].Layer = newLayer
 	}
-	fmt.Fprintln(os.Stderr, "total recompressing took", time.Since(startRecompressing))
+	logger.Info("total recompressing took", "duration", time.Since(startRecompressing))
 
 	// add all leftover History entries
 	for ; historyIdx < len(ocf.History); historyIdx, addendumIdx = historyIdx+1, addendumIdx+1 {
@@ -202,12 +254,12 @@ func zstd(base v1.Image) (v1.Image, error) {
 
 	newImage, err = mutate.Append(newImage, addendums...)
 	if err != nil {
-		return nil, fmt.Errorf("Appending: %w", err)
+		return nil, nil, fmt.Errorf("Appending: %w", err)
 	}
 
 	cf, err := newImage.ConfigFile()
 	if err != nil {
-		return nil, fmt.Errorf("setting config file: %w", err)
+		return nil, nil, fmt.Errorf("setting config file: %w", err)
 	}
 
 	cfg := cf.DeepCopy()
@@ -231,7 +283,11 @@ func zstd(base v1.Image) (v1.Image, error) {
 		cfg.History[i] = h
 	}
 
-	return mutate.ConfigFile(newImage, cfg)
+	img, err := mutate.ConfigFile(newImage, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, recompressed, nil
 }
 
 func getSize(layer v1.Layer) int64 {
@@ -242,7 +298,7 @@ func getSize(layer v1.Layer) int64 {
 	return size
 }
 
-func recompressLayer(layer v1.Layer) (v1.Layer, error) {
+func recompressLayer(layer v1.Layer, logger *logging.Logger) (v1.Layer, error) {
 	uncompLayer, err := newUncompressedLayer(layer)
 	if err != nil {
 		return nil, fmt.Errorf("creating new layer: %w", err)
@@ -263,10 +319,26 @@ func recompressLayer(layer v1.Layer) (v1.Layer, error) {
 	}
 	prevRatio := float64(getSize(layer)) / float64(getSize(uncompLayer))
 	compRatio := float64(getSize(zstdLayer)) / float64(getSize(uncompLayer))
-	fmt.Fprintln(os.Stderr, "compression ratio for layer is", compRatio, "(", prevRatio, "->", compRatio, ")")
+	logger.Debug("compression ratio for layer", "ratio", compRatio, "previous", prevRatio)
 	if compRatio < 0.9 {
-		fmt.Fprintln(os.Stderr, "recompressing using zstd compression")
+		logger.Info("recompressing using zstd compression")
 		return zstdLayer, nil
 	}
 	return uncompLayer, nil
 }
+
+func layerDescriptor(layer v1.Layer) (*v1.Descriptor, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("getting digest %w", err)
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return nil, fmt.Errorf("getting size %w", err)
+	}
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting mediatype %w", err)
+	}
+	return &v1.Descriptor{Digest: digest, Size: size, MediaType: mediaType}, nil
+}
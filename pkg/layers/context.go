@@ -0,0 +1,24 @@
+package layers
+
+import (
+	"context"
+	"io"
+)
+
+// WithContext returns a reader that fails with ctx.Err() once ctx is done,
+// so long tar walks over local or cached data stop on cancellation.
+func WithContext(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
@@ -2,13 +2,48 @@ package layers
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"strings"
+
+	"github.com/anotherjesse/r8im/pkg/logging"
+)
+
+const (
+	weightsPrefix  = "src/weights/"
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
 )
 
-func ExtractTarWithoutPrefixAndIgnoreWhiteout(r io.Reader, dest string) (bool, error) {
+// ErrNoWeights is returned when an image has no weights files.
+var ErrNoWeights = errors.New("no weights found")
+
+// ExtractTarWithoutPrefixAndIgnoreWhiteout copies the weights files under
+// src/weights/ in the layer tar r into a new tar at dest (stdout if empty),
+// returning a manifest entry for each file written. layerDigest is recorded
+// as the source of every entry. If extraction fails or is cancelled, the
+// partial tar at dest is removed.
+func ExtractTarWithoutPrefixAndIgnoreWhiteout(r io.Reader, dest string, layerDigest string, logger *logging.Logger) (files []File, err error) {
+	open := func() (io.ReadCloser, error) { return io.NopCloser(r), nil }
+	return ExtractTars([]LayerTar{{Digest: layerDigest, Open: open}}, dest, logger)
+}
+
+// LayerTar is a layer tar to read weights from, opened when it is reached.
+type LayerTar struct {
+	Digest string
+	Open   func() (io.ReadCloser, error)
+}
+
+// ExtractTars works like ExtractTarWithoutPrefixAndIgnoreWhiteout for the
+// weights split over several layers, in image order, writing them all to
+// the one tar. Layers are read from the top down, so a file is taken from
+// the last layer it is in, and files a layer above deleted are left out.
+func ExtractTars(tars []LayerTar, dest string, logger *logging.Logger) (files []File, err error) {
 	var w io.Writer
 	var file *os.File
 
@@ -16,22 +51,131 @@ func ExtractTarWithoutPrefixAndIgnoreWhiteout(r io.Reader, dest string) (bool, e
 	if dest == "" {
 		w = os.Stdout
 	} else {
-		var err error
 		file, err = os.Create(dest)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-		defer file.Close()
+		defer func() {
+			file.Close()
+			if err != nil {
+				os.Remove(dest)
+			}
+		}()
 		w = file
 	}
 
-	tr := tar.NewReader(r)
 	tw := tar.NewWriter(w)
 	defer tw.Close()
 
-	prefix := "src/weights/"
+	return walkTars(tars, func(header *tar.Header, r io.Reader) error {
+		logger.Info("extracting", "path", header.Name, "size", header.Size)
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	})
+}
+
+// HashTars works like HashWeights for the weights split over several
+// layers, as ExtractTars reads them.
+func HashTars(tars []LayerTar) ([]File, error) {
+	return walkTars(tars, discard)
+}
+
+func walkTars(tars []LayerTar, fn func(*tar.Header, io.Reader) error) ([]File, error) {
+	stack := newLayerStack()
+	files := make([]File, 0)
+	for i := len(tars) - 1; i >= 0; i-- {
+		t := tars[i]
+		rc, err := t.Open()
+		if err != nil {
+			return nil, fmt.Errorf("reading layer %s: %w", t.Digest, err)
+		}
+		found, err := walkWeights(rc, t.Digest, stack, fn)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, found...)
+		stack.next()
+	}
+	return files, nil
+}
+
+// HashWeights computes manifest entries for the weights files in the layer
+// tar r without writing them anywhere.
+func HashWeights(r io.Reader, layerDigest string) ([]File, error) {
+	return walkWeights(r, layerDigest, nil, discard)
+}
+
+func discard(header *tar.Header, r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// layerStack tracks the weights files the layers read so far, from the top
+// down, hide from the ones below: the files they have, and the ones they
+// deleted with whiteouts.
+type layerStack struct {
+	seen    map[string]bool
+	deleted map[string]bool
+	opaque  map[string]bool
+	// deletes of the layer being read, which only apply below it
+	pendingDeleted []string
+	pendingOpaque  []string
+}
+
+func newLayerStack() *layerStack {
+	return &layerStack{seen: map[string]bool{}, deleted: map[string]bool{}, opaque: map[string]bool{}}
+}
+
+// hidden reports whether a layer above has p or deleted it.
+func (s *layerStack) hidden(p string) bool {
+	if s.seen[p] || s.deleted[p] {
+		return true
+	}
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		if s.deleted[dir] || s.opaque[dir] {
+			return true
+		}
+		if dir == "." {
+			return false
+		}
+	}
+}
+
+// whiteout records the whiteout at p, relative to src/weights.
+func (s *layerStack) whiteout(p string) {
+	dir, base := path.Split(p)
+	dir = path.Clean(dir)
+	if base == opaqueWhiteout {
+		s.pendingOpaque = append(s.pendingOpaque, dir)
+	} else {
+		s.pendingDeleted = append(s.pendingDeleted, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+	}
+}
+
+// next moves on to the layer below.
+func (s *layerStack) next() {
+	for _, p := range s.pendingDeleted {
+		s.deleted[p] = true
+	}
+	for _, p := range s.pendingOpaque {
+		s.opaque[p] = true
+	}
+	s.pendingDeleted, s.pendingOpaque = nil, nil
+}
 
-	weightsFound := false
+// walkWeights calls fn for every regular file and symlink under
+// src/weights/ in r, with the prefix stripped from the header name, hashing
+// the contents of files as fn consumes them. Whiteouts are skipped; if stack is not nil they are
+// recorded there, and files it hides are skipped too.
+func walkWeights(r io.Reader, layerDigest string, stack *layerStack, fn func(*tar.Header, io.Reader) error) ([]File, error) {
+	tr := tar.NewReader(r)
+
+	files := make([]File, 0)
 
 	for {
 		header, err := tr.Next()
@@ -39,34 +183,54 @@ func ExtractTarWithoutPrefixAndIgnoreWhiteout(r io.Reader, dest string) (bool, e
 			break
 		}
 		if err != nil {
-			return weightsFound, err
+			return files, err
 		}
 
-		// Ignore whiteout files
-		if strings.Contains(header.Name, ".wh..wh..") {
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if !strings.HasPrefix(name, weightsPrefix) {
 			continue
 		}
+		rel := strings.TrimPrefix(name, weightsPrefix)
 
-		// Check if the path has the desired prefix
-		if header.Typeflag == tar.TypeReg && strings.HasPrefix(header.Name, prefix) {
-			weightsFound = true
+		if strings.HasPrefix(path.Base(rel), whiteoutPrefix) {
+			if stack != nil {
+				stack.whiteout(rel)
+			}
+			continue
+		}
 
-			// Remove the prefix from the path
-			newPath := strings.TrimPrefix(header.Name, prefix)
-			header.Name = newPath
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		if stack != nil {
+			if stack.hidden(rel) {
+				continue
+			}
+			stack.seen[rel] = true
+		}
 
-			fmt.Fprintln(os.Stderr, header.Name)
+		// Remove the prefix from the path
+		header.Name = rel
 
-			err = tw.WriteHeader(header)
-			if err != nil {
-				return weightsFound, err
+		if header.Typeflag == tar.TypeSymlink {
+			if err := fn(header, tr); err != nil {
+				return files, err
 			}
+			files = append(files, File{Path: header.Name, Layer: layerDigest, Link: header.Linkname})
+			continue
+		}
 
-			_, err = io.Copy(tw, tr)
-			if err != nil {
-				return weightsFound, err
-			}
+		h := sha256.New()
+		if err := fn(header, io.TeeReader(tr, h)); err != nil {
+			return files, err
 		}
+
+		files = append(files, File{
+			Path:   header.Name,
+			Size:   header.Size,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+			Layer:  layerDigest,
+		})
 	}
-	return weightsFound, nil
+	return files, nil
 }
@@ -0,0 +1,156 @@
+package layers
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testTar makes a layer tar of entries under src/weights/, given as "path"
+// for a file holding its own path or "path -> target" for a symlink.
+func testTar(t *testing.T, entries ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: weightsPrefix + e, Typeflag: tar.TypeReg, Mode: 0o644}
+		var body string
+		if parts := strings.SplitN(e, " -> ", 2); len(parts) == 2 {
+			hdr.Name, hdr.Linkname = weightsPrefix+parts[0], parts[1]
+			hdr.Typeflag = tar.TypeSymlink
+		} else {
+			body = e
+			hdr.Size = int64(len(body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testTars makes the layer tars of layers, from the bottom up, with digests
+// l0, l1 and so on.
+func testTars(t *testing.T, layers [][]string) []LayerTar {
+	t.Helper()
+	var tars []LayerTar
+	for i, entries := range layers {
+		b := testTar(t, entries...)
+		tars = append(tars, LayerTar{
+			Digest: fmt.Sprintf("l%d", i),
+			Open:   func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(b)), nil },
+		})
+	}
+	return tars
+}
+
+// fileLayers returns files as sorted "path@layer" entries.
+func fileLayers(files []File) []string {
+	got := []string{}
+	for _, f := range files {
+		got = append(got, f.Path+"@"+f.Layer)
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestExtractTarsWhiteouts(t *testing.T) {
+	tests := []struct {
+		name string
+		// layers from the bottom up
+		layers [][]string
+		want   []string
+	}{
+		{
+			name:   "upper file wins",
+			layers: [][]string{{"a", "b"}, {"a"}},
+			want:   []string{"a@l1", "b@l0"},
+		},
+		{
+			name:   "whiteout hides the file below",
+			layers: [][]string{{"a", "b"}, {".wh.a"}},
+			want:   []string{"b@l0"},
+		},
+		{
+			name:   "file added again above a whiteout",
+			layers: [][]string{{"a"}, {".wh.a"}, {"a"}},
+			want:   []string{"a@l2"},
+		},
+		{
+			name:   "whiteout and file in the same layer",
+			layers: [][]string{{"a"}, {".wh.a", "a"}},
+			want:   []string{"a@l1"},
+		},
+		{
+			name:   "whiteout of a directory",
+			layers: [][]string{{"d/a", "d/b", "c"}, {".wh.d"}},
+			want:   []string{"c@l0"},
+		},
+		{
+			name:   "opaque directory",
+			layers: [][]string{{"d/a", "c"}, {"d/.wh..wh..opq", "d/b"}},
+			want:   []string{"c@l0", "d/b@l1"},
+		},
+		{
+			name:   "symlink above a file",
+			layers: [][]string{{"a", "b"}, {"b -> a"}},
+			want:   []string{"a@l0", "b@l1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tars := testTars(t, tt.layers)
+
+			dest := filepath.Join(t.TempDir(), "weights.tar")
+			files, err := ExtractTars(tars, dest, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fileLayers(files); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExtractTars listed %q, want %q", got, tt.want)
+			}
+
+			f, err := os.Open(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var written []string
+			tr := tar.NewReader(f)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				written = append(written, hdr.Name)
+			}
+			if len(written) != len(tt.want) {
+				t.Errorf("ExtractTars wrote %q, want one entry for each of %q", written, tt.want)
+			}
+
+			hashed, err := HashTars(tars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(hashed, files) {
+				t.Errorf("HashTars listed %v, ExtractTars %v", hashed, files)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package layers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ErrVerifyFailed is returned by VerifyReport.Err when a directory does not
+// match its manifest.
+var ErrVerifyFailed = errors.New("weights do not match manifest")
+
+// ManifestLabel is the image config label affix stores the weights
+// manifest under, so tools can list weights without pulling the layer.
+const ManifestLabel = "com.replicate.r8im.weights-manifest"
+
+// File is a single weights file as it appears in an image.
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Layer  string `json:"layer"`
+	// Link is the target of a symlink, which has no size or hash.
+	Link string `json:"link,omitempty"`
+}
+
+// Manifest lists the weights files extracted from an image.
+type Manifest struct {
+	Image string `json:"image"`
+	Files []File `json:"files"`
+}
+
+// WriteManifest writes m as indented JSON to path.
+func WriteManifest(path string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// ReadManifest reads a manifest written by WriteManifest.
+func ReadManifest(path string) (*Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// ManifestFromLabels decodes the weights manifest stored in an image's
+// config labels, returning nil if there is none.
+func ManifestFromLabels(imageName string, labels map[string]string) (*Manifest, error) {
+	v, ok := labels[ManifestLabel]
+	if !ok {
+		return nil, nil
+	}
+	files := make([]File, 0)
+	if err := json.Unmarshal([]byte(v), &files); err != nil {
+		return nil, fmt.Errorf("parsing %s label: %w", ManifestLabel, err)
+	}
+	return &Manifest{Image: imageName, Files: files}, nil
+}
+
+// Mismatch is a file whose size or contents differ from the manifest.
+type Mismatch struct {
+	Expected File
+	Size     int64
+	SHA256   string
+}
+
+// VerifyReport is the result of checking a directory against a manifest.
+type VerifyReport struct {
+	Missing   []File
+	Extra     []string
+	Corrupted []Mismatch
+	Matched   int
+}
+
+// OK reports whether the directory matched the manifest exactly.
+func (r *VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Corrupted) == 0
+}
+
+// Err returns nil if the directory matched, otherwise an error wrapping
+// ErrVerifyFailed that counts the differences.
+func (r *VerifyReport) Err() error {
+	if r.OK() {
+		return nil
+	}
+	return fmt.Errorf("%w: %d missing, %d extra, %d corrupted files", ErrVerifyFailed, len(r.Missing), len(r.Extra), len(r.Corrupted))
+}
+
+// VerifyDir checks the files and symlinks under dir against m. Files are
+// hashed only if their size matches, so a truncated download is reported
+// without reading it in full. A symlink matches if it has the same target,
+// and is corrupted if it is a file in m or the other way around.
+func VerifyDir(dir string, m *Manifest) (*VerifyReport, error) {
+	report := &VerifyReport{
+		Missing:   make([]File, 0),
+		Extra:     make([]string, 0),
+		Corrupted: make([]Mismatch, 0),
+	}
+
+	expected := make(map[string]File, len(m.Files))
+	for _, f := range m.Files {
+		expected[filepath.Clean(f.Path)] = f
+	}
+
+	seen := make(map[string]bool, len(m.Files))
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		link := d.Type()&fs.ModeSymlink != 0
+		if !d.Type().IsRegular() && !link {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		want, ok := expected[rel]
+		if !ok {
+			report.Extra = append(report.Extra, rel)
+			return nil
+		}
+		seen[rel] = true
+
+		if link || want.Link != "" {
+			var target string
+			if link {
+				if target, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+			if target != want.Link {
+				report.Corrupted = append(report.Corrupted, Mismatch{Expected: want})
+				return nil
+			}
+			report.Matched++
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() != want.Size {
+			report.Corrupted = append(report.Corrupted, Mismatch{Expected: want, Size: info.Size()})
+			return nil
+		}
+
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		if sum != want.SHA256 {
+			report.Corrupted = append(report.Corrupted, Mismatch{Expected: want, Size: info.Size(), SHA256: sum})
+			return nil
+		}
+		report.Matched++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for path, f := range expected {
+		if !seen[path] {
+			report.Missing = append(report.Missing, f)
+		}
+	}
+	sort.Slice(report.Missing, func(i, j int) bool {
+		return report.Missing[i].Path < report.Missing[j].Path
+	})
+
+	return report, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,78 @@
+package layers
+
+import (
+	"io"
+	"os"
+)
+
+// WeightsRecorder hashes the weights files of a layer tar as it streams
+// past, so a manifest can be produced without reading the layer twice.
+type WeightsRecorder struct {
+	src   io.ReadCloser
+	pw    *io.PipeWriter
+	done  chan struct{}
+	files []File
+	err   error
+}
+
+// NewWeightsRecorder returns a recorder that tees everything read from src
+// into a tar parser. Read the layer through the recorder, then call Files.
+func NewWeightsRecorder(src io.ReadCloser) *WeightsRecorder {
+	pr, pw := io.Pipe()
+	w := &WeightsRecorder{
+		src:  src,
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		w.files, w.err = HashWeights(pr, "")
+		// drain the tar padding so the writer side never blocks
+		io.Copy(io.Discard, pr)
+		pr.Close()
+	}()
+	return w
+}
+
+func (w *WeightsRecorder) Read(b []byte) (int, error) {
+	n, err := w.src.Read(b)
+	if n > 0 {
+		w.pw.Write(b[:n])
+	}
+	if err == io.EOF {
+		w.pw.Close()
+	}
+	return n, err
+}
+
+// Close closes the underlying reader. If the stream was not read to the
+// end, Files reports an error.
+func (w *WeightsRecorder) Close() error {
+	w.pw.CloseWithError(io.ErrUnexpectedEOF)
+	return w.src.Close()
+}
+
+// Files waits for the stream to be consumed and returns the weights files
+// found in it.
+func (w *WeightsRecorder) Files() ([]File, error) {
+	<-w.done
+	return w.files, w.err
+}
+
+// ScanWeights hashes the weights files in the tar (optionally gzipped) at
+// path.
+func ScanWeights(path string) ([]File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rc, err := Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return HashWeights(rc, "")
+}
@@ -0,0 +1,240 @@
+package layers
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Shard is a set of weights files that go into one layer.
+type Shard struct {
+	// Files are paths relative to the weights directory, with forward
+	// slashes, in lexical order.
+	Files []string
+	Size  int64
+	// Deleted are paths, like Files, to write whiteouts for, so that the
+	// layer deletes them from the layers below.
+	Deleted []string
+}
+
+// PlanShards splits the files under dir into layers of about target bytes
+// or, if target is 0, into about n layers. Files go in path order, and a
+// layer ends after each file with a chance of its size over target, decided
+// by a hash of its path, so where layers end doesn't depend on the other
+// files: a file that changes only changes its own layer, or at most merges
+// or splits it with the next, and the other layers are the same as before.
+// Files of target bytes or more get a layer of their own. To keep sizes
+// bounded, a layer doesn't end before it has target/4 bytes, and does end
+// before going over target*4; the layers after such a cut line up with the
+// hashed ends again at the next one. With n, target is the total size over
+// n rounded to a power of two, so it doesn't move as the weights change a
+// little, and n is only the rough number of layers. With neither n nor
+// target set, everything goes into one shard.
+func PlanShards(dir string, n int, target int64) ([]Shard, error) {
+	var files []string
+	sizes := map[string]int64{}
+	var total int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			return fmt.Errorf("%s: unsupported file type %s", p, d.Type())
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		files = append(files, rel)
+		if fi.Mode().IsRegular() {
+			sizes[rel] = fi.Size()
+			total += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w in %s", ErrNoWeights, dir)
+	}
+
+	if target <= 0 && n > 1 {
+		per := math.Max(float64(total)/float64(n), 1)
+		target = 1 << int(math.Round(math.Log2(per)))
+	}
+	if target <= 0 {
+		return []Shard{{Files: files, Size: total}}, nil
+	}
+
+	minSize, maxSize := target/4, target*4
+	var shards []Shard
+	var cur Shard
+	for _, f := range files {
+		size := sizes[f]
+		if size >= target {
+			if len(cur.Files) > 0 {
+				shards = append(shards, cur)
+				cur = Shard{}
+			}
+			shards = append(shards, Shard{Files: []string{f}, Size: size})
+			continue
+		}
+		if len(cur.Files) > 0 && cur.Size+size > maxSize {
+			shards = append(shards, cur)
+			cur = Shard{}
+		}
+		cur.Files = append(cur.Files, f)
+		cur.Size += size
+		if cur.Size >= minSize && endsShard(f, size, target) {
+			shards = append(shards, cur)
+			cur = Shard{}
+		}
+	}
+	if len(cur.Files) > 0 {
+		shards = append(shards, cur)
+	}
+	return shards, nil
+}
+
+// endsShard reports whether a shard ends after the file at p of size bytes,
+// with a chance of size over target.
+func endsShard(p string, size int64, target int64) bool {
+	sum := sha256.Sum256([]byte(p))
+	h := float64(binary.BigEndian.Uint64(sum[:8])) / (1 << 64)
+	return h*float64(target) < float64(size)
+}
+
+// WriteShard writes the files of s under dir to w as a tar with the files
+// under src/weights/, followed by whiteouts for s.Deleted. The tar only
+// depends on the contents and modes of the files, so the same files always
+// make the same layer.
+func WriteShard(w io.Writer, dir string, s Shard) error {
+	tw := tar.NewWriter(w)
+	written := map[string]bool{}
+	var epoch time.Time
+
+	var writeDir func(p string) error
+	writeDir = func(p string) error {
+		if p == "." || written[p] {
+			return nil
+		}
+		if err := writeDir(path.Dir(p)); err != nil {
+			return err
+		}
+		written[p] = true
+		return tw.WriteHeader(&tar.Header{
+			Name:     p + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0o755,
+			ModTime:  epoch,
+		})
+	}
+
+	for _, f := range s.Files {
+		name := weightsPrefix + f
+		if err := writeDir(path.Dir(name)); err != nil {
+			return err
+		}
+
+		src := filepath.Join(dir, filepath.FromSlash(f))
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    int64(fi.Mode().Perm()),
+			ModTime: epoch,
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			hdr.Typeflag = tar.TypeSymlink
+			if hdr.Linkname, err = os.Readlink(src); err != nil {
+				return err
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = fi.Size()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyFile(tw, src); err != nil {
+			return fmt.Errorf("writing %s: %w", f, err)
+		}
+	}
+
+	for _, f := range s.Deleted {
+		dir, base := path.Split(weightsPrefix + f)
+		if err := writeDir(path.Clean(dir)); err != nil {
+			return err
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Name:     dir + whiteoutPrefix + base,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			ModTime:  epoch,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ShardFiles returns the manifest entries of the files and symlinks of s
+// under dir, recording layerDigest as their layer.
+func ShardFiles(dir string, s Shard, layerDigest string) ([]File, error) {
+	files := make([]File, 0, len(s.Files))
+	for _, f := range s.Files {
+		src := filepath.Join(dir, filepath.FromSlash(f))
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(src)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, File{Path: f, Layer: layerDigest, Link: target})
+			continue
+		}
+		sum, err := hashFile(src)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, File{Path: f, Size: fi.Size(), SHA256: sum, Layer: layerDigest})
+	}
+	return files, nil
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
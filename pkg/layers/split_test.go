@@ -0,0 +1,141 @@
+package layers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTarget = 4 << 10
+
+// writeWeights writes files of the given sizes under a new directory.
+func writeWeights(t *testing.T, sizes map[string]int) string {
+	t.Helper()
+	dir := t.TempDir()
+	for p, size := range sizes {
+		full := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// testWeights returns 300 files of 100 to 1000 bytes, in a few directories.
+func testWeights() map[string]int {
+	sizes := map[string]int{}
+	for i := 0; i < 300; i++ {
+		sizes[fmt.Sprintf("d%d/f%03d.bin", i%3, i)] = 100 + i*37%900
+	}
+	return sizes
+}
+
+func planShards(t *testing.T, sizes map[string]int, n int, target int64) []Shard {
+	t.Helper()
+	shards, err := PlanShards(writeWeights(t, sizes), n, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shards
+}
+
+// changedShards counts the shards of b whose files aren't a shard of a.
+func changedShards(a, b []Shard) int {
+	before := map[string]bool{}
+	for _, s := range a {
+		before[strings.Join(s.Files, "\n")] = true
+	}
+	n := 0
+	for _, s := range b {
+		if !before[strings.Join(s.Files, "\n")] {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPlanShardsStable(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(sizes map[string]int)
+		// most shards that may change: the file's own and those after it
+		// until the ends line up again
+		max int
+	}{
+		{"file grows", func(sizes map[string]int) { sizes["d1/f100.bin"] += 500 }, 3},
+		{"file shrinks", func(sizes map[string]int) { sizes["d2/f200.bin"] = 10 }, 3},
+		{"file added", func(sizes map[string]int) { sizes["d0/f150a.bin"] = 700 }, 3},
+		{"file removed", func(sizes map[string]int) { delete(sizes, "d0/f051.bin") }, 3},
+		// splits the shard it lands in around a shard of its own
+		{"large file added", func(sizes map[string]int) { sizes["d1/big.bin"] = 3 * testTarget }, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sizes := testWeights()
+			before := planShards(t, sizes, 0, testTarget)
+			tt.change(sizes)
+			after := planShards(t, sizes, 0, testTarget)
+			if n := changedShards(before, after); n > tt.max {
+				t.Errorf("changing one file changed %d of %d shards", n, len(after))
+			}
+		})
+	}
+}
+
+func TestPlanShardsBounds(t *testing.T) {
+	sizes := testWeights()
+	sizes["d1/big.bin"] = 10 * testTarget
+	shards := planShards(t, sizes, 0, testTarget)
+	for i, s := range shards {
+		if len(s.Files) == 1 && s.Files[0] == "d1/big.bin" {
+			continue
+		}
+		if s.Size > 4*testTarget {
+			t.Errorf("shard %d has %d bytes, over 4 times the target", i, s.Size)
+		}
+		// the shards before the large file and at the end may be cut short
+		if s.Size < testTarget/4 && i != len(shards)-1 && !contains(shards[i+1].Files, "d1/big.bin") {
+			t.Errorf("shard %d has %d bytes, under a quarter of the target", i, s.Size)
+		}
+	}
+	found := false
+	for _, s := range shards {
+		if contains(s.Files, "d1/big.bin") {
+			found = len(s.Files) == 1
+		}
+	}
+	if !found {
+		t.Error("a file over the target doesn't have a shard of its own")
+	}
+}
+
+func TestPlanShardsLayers(t *testing.T) {
+	sizes := testWeights()
+	var total int
+	for _, size := range sizes {
+		total += size
+	}
+	for _, n := range []int{1, 4, 16} {
+		shards := planShards(t, sizes, n, 0)
+		if n == 1 && len(shards) != 1 {
+			t.Errorf("--layers 1 made %d shards", len(shards))
+		}
+		if len(shards) < n/4 || len(shards) > n*4 {
+			t.Errorf("--layers %d made %d shards of %d bytes", n, len(shards), total)
+		}
+	}
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Formats accepted by New.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Logger writes leveled messages with key/value attributes, either as
+// human-readable text or as one JSON object per line. A nil Logger is valid
+// and discards everything.
+type Logger struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+	attrs []interface{}
+}
+
+// New returns a Logger writing messages at level and above to w.
+func New(w io.Writer, level Level, format string) (*Logger, error) {
+	l := &Logger{mu: &sync.Mutex{}, w: w, level: level}
+	switch format {
+	case FormatText:
+	case FormatJSON:
+		l.json = true
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	return l, nil
+}
+
+// With returns a Logger that adds the given key/value pairs to every
+// message.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	child := *l
+	child.attrs = append(append([]interface{}{}, l.attrs...), kv...)
+	return &child
+}
+
+// Enabled reports whether messages at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(LevelInfo, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(LevelWarn, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Log writes msg at level with alternating key/value attributes.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	kv = append(append([]interface{}{}, l.attrs...), kv...)
+
+	var line string
+	if l.json {
+		line = l.formatJSON(level, msg, kv)
+	} else {
+		line = l.formatText(level, msg, kv)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line+"\n")
+}
+
+func (l *Logger) formatText(level Level, msg string, kv []interface{}) string {
+	var b strings.Builder
+	if level != LevelInfo {
+		b.WriteString(strings.ToUpper(level.String()))
+		b.WriteString(": ")
+	}
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		key, value := pair(kv, i)
+		s := fmt.Sprint(value)
+		if strings.ContainsAny(s, " \t\"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, s)
+	}
+	return b.String()
+}
+
+func (l *Logger) formatJSON(level Level, msg string, kv []interface{}) string {
+	m := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	for i := 0; i < len(kv); i += 2 {
+		key, value := pair(kv, i)
+		switch v := value.(type) {
+		case time.Duration:
+			// durations are reported in seconds so they sort and sum
+			value = v.Seconds()
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		m[key] = value
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Sprintf(`{"level":"error","msg":"marshalling log message: %v"}`, err)
+	}
+	return string(b)
+}
+
+func pair(kv []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(kv[i])
+	if i+1 >= len(kv) {
+		return "!BADKEY", kv[i]
+	}
+	return key, kv[i+1]
+}
+
+// StdLogger returns a *log.Logger whose output is logged at level, for
+// libraries such as go-containerregistry that log through the standard
+// library.
+func (l *Logger) StdLogger(level Level) *log.Logger {
+	if !l.Enabled(level) {
+		return log.New(io.Discard, "", 0)
+	}
+	return log.New(&stdWriter{l: l, level: level}, "", 0)
+}
+
+type stdWriter struct {
+	l     *Logger
+	level Level
+}
+
+func (w *stdWriter) Write(b []byte) (int, error) {
+	w.l.Log(w.level, strings.TrimRight(string(b), "\n"))
+	return len(b), nil
+}
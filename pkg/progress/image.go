@@ -0,0 +1,85 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	r8Layers "github.com/anotherjesse/r8im/pkg/layers"
+)
+
+// Image wraps img so that downloading any of its layers is reported. Only
+// wrap images whose layers are read: pushing a wrapped image hides the
+// remote layers from go-containerregistry, which then cannot mount them.
+func (r *Reporter) Image(img v1.Image) v1.Image {
+	if r == nil {
+		return img
+	}
+	return &image{Image: img, r: r}
+}
+
+type image struct {
+	v1.Image
+	r *Reporter
+}
+
+func (i *image) Layers() ([]v1.Layer, error) {
+	ls, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]v1.Layer, len(ls))
+	for idx, l := range ls {
+		out[idx] = &layer{Layer: l, r: i.r}
+	}
+	return out, nil
+}
+
+func (i *image) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return &layer{Layer: l, r: i.r}, nil
+}
+
+func (i *image) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDiffID(h)
+	if err != nil {
+		return nil, err
+	}
+	return &layer{Layer: l, r: i.r}, nil
+}
+
+type layer struct {
+	v1.Layer
+	r *Reporter
+}
+
+func (l *layer) Compressed() (io.ReadCloser, error) {
+	digest, err := l.Layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	size, err := l.Layer.Size()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	t := l.r.Start(fmt.Sprintf("pull %.19s", digest), size)
+	return t.Reader(rc), nil
+}
+
+// Uncompressed decompresses the reported compressed stream, so progress is
+// measured against the layer's download size.
+func (l *layer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return r8Layers.Decompress(rc)
+}
@@ -0,0 +1,422 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Formats accepted by New.
+const (
+	FormatAuto  = "auto"
+	FormatBar   = "bar"
+	FormatPlain = "plain"
+	FormatJSON  = "json"
+	FormatNone  = "none"
+)
+
+const (
+	barInterval   = 200 * time.Millisecond
+	plainInterval = 10 * time.Second
+	jsonInterval  = time.Second
+	barWidth      = 30
+)
+
+// Reporter renders the progress of concurrent transfers. A nil Reporter is
+// valid and reports nothing.
+type Reporter struct {
+	w        io.Writer
+	format   string
+	interval time.Duration
+
+	mu        sync.Mutex
+	tasks     []*Task
+	drawn     int
+	lastDrawn time.Time
+}
+
+// New returns a Reporter writing to w in the given format. FormatAuto picks
+// FormatBar when w is a terminal and FormatPlain otherwise.
+func New(w io.Writer, format string) (*Reporter, error) {
+	if format == FormatAuto {
+		format = FormatPlain
+		if isTerminal(w) {
+			format = FormatBar
+		}
+	}
+
+	r := &Reporter{w: w, format: format}
+	switch format {
+	case FormatBar:
+		r.interval = barInterval
+	case FormatPlain:
+		r.interval = plainInterval
+	case FormatJSON:
+		r.interval = jsonInterval
+	case FormatNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown progress format %q, expected auto, bar, plain, json or none", format)
+	}
+	return r, nil
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Task is a single transfer, such as pulling or pushing one layer. A nil
+// Task is valid and reports nothing.
+type Task struct {
+	r        *Reporter
+	name     string
+	start    time.Time
+	total    int64
+	complete int64
+
+	lastReport time.Time
+}
+
+// Start begins reporting a transfer of total bytes. Pass a total of zero or
+// less if it is not known up front.
+func (r *Reporter) Start(name string, total int64) *Task {
+	if r == nil {
+		return nil
+	}
+
+	t := &Task{r: r, name: name, start: time.Now(), total: total}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tasks = append(r.tasks, t)
+	if r.format == FormatJSON {
+		r.emitJSON(t, "start", nil)
+	}
+	return t
+}
+
+// Add records n more bytes transferred.
+func (t *Task) Add(n int64) {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.complete, n)
+	t.r.update(t)
+}
+
+// Set records the absolute progress of the transfer.
+func (t *Task) Set(complete, total int64) {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt64(&t.complete, complete)
+	atomic.StoreInt64(&t.total, total)
+	t.r.update(t)
+}
+
+// Done finishes the transfer, successfully if err is nil.
+func (t *Task) Done(err error) {
+	if t == nil {
+		return
+	}
+	r := t.r
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, task := range r.tasks {
+		if task == t {
+			r.tasks = append(r.tasks[:i], r.tasks[i+1:]...)
+			break
+		}
+	}
+
+	switch r.format {
+	case FormatJSON:
+		event := "done"
+		if err != nil {
+			event = "error"
+		}
+		r.emitJSON(t, event, err)
+	case FormatBar:
+		r.clear()
+		fmt.Fprintln(r.w, t.summary(err))
+		r.draw()
+	case FormatPlain:
+		fmt.Fprintln(r.w, t.summary(err))
+	}
+}
+
+// Reader returns rc with every byte read from it reported to t. The task
+// is finished when the reader is closed.
+func (t *Task) Reader(rc io.ReadCloser) io.ReadCloser {
+	if t == nil {
+		return rc
+	}
+	return &reader{rc: rc, t: t}
+}
+
+// Updates returns a channel to pass to remote.WithProgress, and finish, to
+// call with the result of the transfer once it returns. The task is
+// finished when go-containerregistry closes the channel or, if the transfer
+// failed before it got that far, by finish itself; finish blocks until then.
+func (t *Task) Updates() (updates chan<- v1.Update, finish func(error)) {
+	if t == nil {
+		return nil, func(error) {}
+	}
+
+	ch := make(chan v1.Update, 16)
+	returned := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		for {
+			select {
+			case u, ok := <-ch:
+				if !ok {
+					t.Done(err)
+					return
+				}
+				if u.Error != nil {
+					if u.Error != io.EOF {
+						err = u.Error
+					}
+					continue
+				}
+				t.Set(u.Complete, u.Total)
+			case rerr := <-returned:
+				if rerr != nil {
+					// the channel may never be closed, and nothing more
+					// is sent on it once the transfer has returned
+					t.Done(rerr)
+					return
+				}
+				// keep reading until the channel is closed
+				returned = nil
+			}
+		}
+	}()
+	return ch, func(err error) {
+		returned <- err
+		<-done
+	}
+}
+
+func (r *Reporter) update(t *Task) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	switch r.format {
+	case FormatBar:
+		if now.Sub(r.lastDrawn) < r.interval {
+			return
+		}
+		r.lastDrawn = now
+		r.clear()
+		r.draw()
+	case FormatPlain:
+		if now.Sub(t.lastReport) < r.interval {
+			return
+		}
+		t.lastReport = now
+		fmt.Fprintln(r.w, t.line())
+	case FormatJSON:
+		if now.Sub(t.lastReport) < r.interval {
+			return
+		}
+		t.lastReport = now
+		r.emitJSON(t, "progress", nil)
+	}
+}
+
+// clear erases the bars drawn last time. Callers hold r.mu.
+func (r *Reporter) clear() {
+	if r.drawn > 0 {
+		fmt.Fprintf(r.w, "\x1b[%dA\x1b[J", r.drawn)
+	}
+	r.drawn = 0
+}
+
+// draw renders a bar per active task. Callers hold r.mu.
+func (r *Reporter) draw() {
+	for _, t := range r.tasks {
+		fmt.Fprintln(r.w, t.bar())
+	}
+	r.drawn = len(r.tasks)
+}
+
+type event struct {
+	Time     time.Time `json:"time"`
+	Task     string    `json:"task"`
+	Event    string    `json:"event"`
+	Complete int64     `json:"complete"`
+	Total    int64     `json:"total,omitempty"`
+	Rate     float64   `json:"bytesPerSecond"`
+	ETA      float64   `json:"etaSeconds,omitempty"`
+	Elapsed  float64   `json:"elapsedSeconds"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// emitJSON writes a single JSON line for t. Callers hold r.mu.
+func (r *Reporter) emitJSON(t *Task, name string, err error) {
+	complete, total := t.counts()
+	e := event{
+		Time:     time.Now().UTC(),
+		Task:     t.name,
+		Event:    name,
+		Complete: complete,
+		Total:    total,
+		Rate:     t.rate(),
+		ETA:      t.eta().Seconds(),
+		Elapsed:  time.Since(t.start).Seconds(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b, _ := json.Marshal(e)
+	fmt.Fprintln(r.w, string(b))
+}
+
+func (t *Task) counts() (complete, total int64) {
+	return atomic.LoadInt64(&t.complete), atomic.LoadInt64(&t.total)
+}
+
+func (t *Task) rate() float64 {
+	elapsed := time.Since(t.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	complete, _ := t.counts()
+	return float64(complete) / elapsed
+}
+
+func (t *Task) eta() time.Duration {
+	complete, total := t.counts()
+	rate := t.rate()
+	if total <= 0 || rate <= 0 || complete >= total {
+		return 0
+	}
+	return time.Duration(float64(total-complete)/rate) * time.Second
+}
+
+func (t *Task) line() string {
+	complete, total := t.counts()
+	if total <= 0 {
+		return fmt.Sprintf("%s: %s %s/s", t.name, formatBytes(complete), formatBytes(int64(t.rate())))
+	}
+	return fmt.Sprintf("%s: %s/%s (%d%%) %s/s ETA %s", t.name,
+		formatBytes(complete), formatBytes(total), percent(complete, total),
+		formatBytes(int64(t.rate())), t.eta().Round(time.Second))
+}
+
+func (t *Task) bar() string {
+	complete, total := t.counts()
+	if total <= 0 {
+		return t.line()
+	}
+	filled := int(float64(barWidth) * float64(complete) / float64(total))
+	if filled > barWidth {
+		filled = barWidth
+	}
+	return fmt.Sprintf("%s [%s%s] %3d%% %s/%s %s/s ETA %s", t.name,
+		strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled),
+		percent(complete, total), formatBytes(complete), formatBytes(total),
+		formatBytes(int64(t.rate())), t.eta().Round(time.Second))
+}
+
+func (t *Task) summary(err error) string {
+	complete, _ := t.counts()
+	elapsed := time.Since(t.start)
+	if err != nil {
+		return fmt.Sprintf("%s: failed after %s: %v", t.name, elapsed.Round(time.Millisecond), err)
+	}
+	return fmt.Sprintf("%s: %s in %s (%s/s)", t.name, formatBytes(complete),
+		elapsed.Round(time.Millisecond), formatBytes(int64(t.rate())))
+}
+
+func percent(complete, total int64) int {
+	p := int(complete * 100 / total)
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+type reader struct {
+	rc   io.ReadCloser
+	t    *Task
+	err  error
+	once sync.Once
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	n, err := r.rc.Read(b)
+	if n > 0 {
+		r.t.Add(int64(n))
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *reader) Close() error {
+	err := r.rc.Close()
+	r.once.Do(func() { r.t.Done(r.err) })
+	return err
+}
+
+// Writer returns a writer for other output sharing the reporter's terminal.
+// When bars are being drawn they are cleared before each write and redrawn
+// after it, so log lines are not overwritten.
+func (r *Reporter) Writer(w io.Writer) io.Writer {
+	if r == nil || r.format != FormatBar {
+		return w
+	}
+	return &barWriter{r: r, w: w}
+}
+
+type barWriter struct {
+	r *Reporter
+	w io.Writer
+}
+
+func (b *barWriter) Write(p []byte) (int, error) {
+	b.r.mu.Lock()
+	defer b.r.mu.Unlock()
+
+	b.r.clear()
+	n, err := b.w.Write(p)
+	b.r.draw()
+	return n, err
+}
@@ -0,0 +1,139 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// HostConfig holds the settings for one registry host.
+type HostConfig struct {
+	// Insecure allows plain HTTP and skips TLS certificate verification.
+	Insecure bool `json:"insecure,omitempty"`
+	// CAFile is a PEM bundle of certificate authorities to trust in
+	// addition to the system ones.
+	CAFile string `json:"caFile,omitempty"`
+	// Cog marks a registry that verifies cog tokens, like r8.im.
+	Cog bool `json:"cog,omitempty"`
+}
+
+// Config is the per-host registry configuration read by LoadConfig, keyed
+// by host as it appears in image references, such as "localhost:5000".
+type Config struct {
+	Hosts map[string]HostConfig `json:"hosts"`
+}
+
+// LoadConfig reads a registry configuration file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Lookup returns the entry of hosts for host, a registry host as it
+// appears in image references: the entry for host itself, such as
+// "localhost:5000", or else the one for its name without the port.
+func Lookup[V any](hosts map[string]V, host string) (V, bool) {
+	if v, ok := hosts[host]; ok {
+		return v, true
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		v, ok := hosts[name]
+		return v, ok
+	}
+	var v V
+	return v, false
+}
+
+// Host returns the settings for host: its entry in Hosts if there is one,
+// found as by Lookup, with Insecure and CAFile from opts as defaults.
+func (o Options) Host(host string) HostConfig {
+	h, _ := Lookup(o.Hosts, host)
+	h.Insecure = h.Insecure || o.Insecure
+	if h.CAFile == "" {
+		h.CAFile = o.CAFile
+	}
+	return h
+}
+
+// InsecureHosts lists the hosts configured as insecure in Hosts.
+func (o Options) InsecureHosts() []string {
+	var hosts []string
+	for host, h := range o.Hosts {
+		if h.Insecure {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// tlsConfig returns the TLS configuration for h, or nil for the defaults.
+func (h HostConfig) tlsConfig() (*tls.Config, error) {
+	if !h.Insecure && h.CAFile == "" {
+		return nil, nil
+	}
+	c := &tls.Config{InsecureSkipVerify: h.Insecure}
+	if h.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(h.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", h.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	return c, nil
+}
+
+// hostTransport sends each request through the transport for its host, so
+// that hosts can have their own TLS settings.
+type hostTransport struct {
+	fallback http.RoundTripper
+	hosts    map[string]http.RoundTripper
+}
+
+func newHostTransport(base *http.Transport, opts Options) (*hostTransport, error) {
+	forHost := func(h HostConfig) (http.RoundTripper, error) {
+		c, err := h.tlsConfig()
+		if err != nil || c == nil {
+			return base, err
+		}
+		t := base.Clone()
+		t.TLSClientConfig = c
+		return t, nil
+	}
+
+	fallback, err := forHost(opts.Host(""))
+	if err != nil {
+		return nil, err
+	}
+	t := &hostTransport{fallback: fallback, hosts: map[string]http.RoundTripper{}}
+	for host := range opts.Hosts {
+		if t.hosts[host], err = forHost(opts.Host(host)); err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+	}
+	return t, nil
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := Lookup(t.hosts, req.URL.Host); ok {
+		return rt.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
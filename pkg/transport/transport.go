@@ -0,0 +1,262 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	gcrTransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/anotherjesse/r8im/pkg/logging"
+)
+
+// Defaults for Options.
+const (
+	DefaultTimeout    = 2 * time.Minute
+	DefaultRetries    = 5
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// maxRetryAfter caps how long a Retry-After header can make us wait.
+const maxRetryAfter = 10 * time.Minute
+
+// Options configures the transport returned by New.
+type Options struct {
+	// Timeout bounds connecting to a registry and waiting for the response
+	// headers. It does not bound transferring the body, so large uploads
+	// and downloads can take as long as they need.
+	Timeout time.Duration
+	// Retries is how many times a failed request is retried.
+	Retries int
+	// MinBackoff and MaxBackoff bound the exponential backoff between
+	// retries.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Insecure and CAFile apply to every host, unless overridden in Hosts.
+	Insecure bool
+	CAFile   string
+	Hosts    map[string]HostConfig
+
+	Logger *logging.Logger
+}
+
+// DefaultOptions returns the options used by the r8im command line.
+func DefaultOptions() Options {
+	return Options{
+		Timeout:    DefaultTimeout,
+		Retries:    DefaultRetries,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
+// New returns a transport with the timeouts and TLS settings in opts that
+// retries requests failing with a timeout, a dropped connection, 429 or
+// 5xx. Retries wait with exponential backoff and jitter, or as long as the
+// server's Retry-After asks. Requests whose body can't be replayed, such as
+// streamed blob uploads, are sent once; Backoff and Retryable configure
+// go-containerregistry to retry those whole.
+func New(opts Options) (http.RoundTripper, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Timeout > 0 {
+		t.DialContext = (&net.Dialer{
+			Timeout:   opts.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		t.TLSHandshakeTimeout = opts.Timeout
+		t.ResponseHeaderTimeout = opts.Timeout
+	}
+	hosts, err := newHostTransport(t, opts)
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(hosts, opts), nil
+}
+
+// Wrap adds the retry behaviour of New to inner.
+func Wrap(inner http.RoundTripper, opts Options) http.RoundTripper {
+	return &retryTransport{inner: inner, opts: opts}
+}
+
+// Client returns an http.Client using New(opts).
+func Client(opts Options) (*http.Client, error) {
+	t, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// Backoff returns the equivalent go-containerregistry backoff, for it to
+// retry whole blob uploads and manifest writes that fail with an error
+// Retryable accepts.
+func (o Options) Backoff() remote.Backoff {
+	// go-containerregistry gives up once the backoff reaches its cap, so
+	// instead of capping it, grow it slower if it would pass MaxBackoff
+	factor := 2.0
+	if o.MaxBackoff <= o.MinBackoff {
+		factor = 1
+	} else if o.Retries > 1 && o.MinBackoff > 0 {
+		f := math.Pow(float64(o.MaxBackoff)/float64(o.MinBackoff), 1/float64(o.Retries-1))
+		factor = math.Min(factor, f)
+	}
+	return remote.Backoff{
+		Duration: o.MinBackoff,
+		Factor:   factor,
+		Jitter:   0.5,
+		Steps:    o.Retries + 1,
+	}
+}
+
+// backoff returns how long to wait before retry number attempt (from 0),
+// with jitter so that parallel uploads don't retry in lockstep.
+func (o Options) backoff(attempt int) time.Duration {
+	d := o.MinBackoff
+	for i := 0; i < attempt && d < o.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// wait somewhere between d/2 and d
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+type retryTransport struct {
+	inner http.RoundTripper
+	opts  Options
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.inner.RoundTrip(req)
+
+		if attempt >= t.opts.Retries || !retryable(req, resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		wait := t.opts.backoff(attempt)
+		kv := []interface{}{"method", req.Method, "url", req.URL.Redacted(), "attempt", attempt + 1}
+		if err != nil {
+			kv = append(kv, "error", err)
+		} else {
+			kv = append(kv, "status", resp.StatusCode)
+			if after, ok := retryAfter(resp); ok {
+				wait = after
+			}
+			// drain so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		t.opts.Logger.Warn("retrying request", append(kv, "wait", wait)...)
+
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+
+		if req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// Retryable reports whether go-containerregistry should retry a blob upload
+// or manifest write that failed with err: the same failures New retries.
+func Retryable(err error) bool {
+	var terr *gcrTransport.Error
+	if errors.As(err, &terr) {
+		return retryableStatus(terr.StatusCode)
+	}
+	return temporary(err)
+}
+
+// retryable reports whether a request that got resp or err can be sent
+// again.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return temporary(err)
+	}
+	return retryableStatus(resp.StatusCode)
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// temporary reports whether err is a network failure that may go away,
+// as opposed to one such as a TLS or DNS error that will happen again.
+func temporary(err error) bool {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// retryAfter parses the Retry-After header, either a number of seconds or
+// an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	} else {
+		return 0, false
+	}
+	if d < 0 {
+		d = 0
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d, true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name string
+		// statuses the server answers with in turn, repeating the last
+		statuses   []int
+		retryAfter string
+		// body is sent with a POST that can't be replayed if unreplayable
+		body         string
+		unreplayable bool
+		wantStatus   int
+		wantAttempts int32
+		minWait      time.Duration
+	}{
+		{name: "success", statuses: []int{200}, wantStatus: 200, wantAttempts: 1},
+		{name: "429 then success", statuses: []int{429, 200}, retryAfter: "0", wantStatus: 200, wantAttempts: 2},
+		{name: "429 waits for Retry-After", statuses: []int{429, 200}, retryAfter: "1", wantStatus: 200, wantAttempts: 2, minWait: time.Second},
+		{name: "5xx until retries run out", statuses: []int{503}, wantStatus: 503, wantAttempts: 3},
+		{name: "500 then 502 then success", statuses: []int{500, 502, 200}, wantStatus: 200, wantAttempts: 3},
+		{name: "404 isn't retried", statuses: []int{404}, wantStatus: 404, wantAttempts: 1},
+		{name: "401 isn't retried", statuses: []int{401}, wantStatus: 401, wantAttempts: 1},
+		{name: "body is sent again", statuses: []int{503, 201}, body: "blob", wantStatus: 201, wantAttempts: 2},
+		{name: "unreplayable body isn't retried", statuses: []int{503}, body: "blob", unreplayable: true, wantStatus: 503, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&attempts, 1))
+				if b, _ := io.ReadAll(r.Body); string(b) != tt.body {
+					t.Errorf("attempt %d sent %q, want %q", n, b, tt.body)
+				}
+				status := tt.statuses[len(tt.statuses)-1]
+				if n <= len(tt.statuses) {
+					status = tt.statuses[n-1]
+				}
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+			}))
+			defer s.Close()
+
+			rt := Wrap(http.DefaultTransport, Options{Retries: 2, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+			method := http.MethodGet
+			var body io.Reader
+			if tt.body != "" {
+				method = http.MethodPost
+				body = strings.NewReader(tt.body)
+				if tt.unreplayable {
+					// hide the strings.Reader so the request has no GetBody
+					body = io.MultiReader(body)
+				}
+			}
+			req, err := http.NewRequest(method, s.URL, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := atomic.LoadInt32(&attempts); got != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", got, tt.wantAttempts)
+			}
+			if waited := time.Since(start); waited < tt.minWait {
+				t.Errorf("retried after %s, want at least %s", waited, tt.minWait)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: "", wantOK: false},
+		{value: "soon", wantOK: false},
+		{value: "0", want: 0, wantOK: true},
+		{value: "30", want: 30 * time.Second, wantOK: true},
+		{value: "-5", want: 0, wantOK: true},
+		{value: "86400", want: maxRetryAfter, wantOK: true},
+		{value: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0, wantOK: true},
+		{value: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), want: maxRetryAfter, wantOK: true},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.value != "" {
+			resp.Header.Set("Retry-After", tt.value)
+		}
+		got, ok := retryAfter(resp)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("retryAfter(%q) = %s, %v; want %s, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	// a date a minute away is about a minute, give or take the clock's
+	// resolution of a second
+	resp := &http.Response{Header: http.Header{"Retry-After": {time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}}}
+	if got, ok := retryAfter(resp); !ok || got < 58*time.Second || got > time.Minute {
+		t.Errorf("retryAfter a minute from now = %s, %v", got, ok)
+	}
+}